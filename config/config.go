@@ -0,0 +1,667 @@
+package config
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/filter"
+)
+
+// The top level of a route table document.
+//
+//	{
+//	  "pools": {
+//	    "app": {
+//	      "timeout": "5s",
+//	      "ping_path": "/ping",
+//	      "servers": [{"host": "10.0.0.1", "port": 8080}, {"host": "10.0.0.2", "port": 8080}]
+//	    }
+//	  },
+//	  "pipeline": {
+//	    "upstream": [
+//	      {"type": "host_router", "hosts": {
+//	        "static.example.com": {"type": "file", "base_path": "/var/www"},
+//	        "www.example.com": {"type": "path_router", "routes": [
+//	          {"match": "^/api/", "filter": {"type": "pool", "pool": "app"}}
+//	        ]}
+//	      }}
+//	    ],
+//	    "downstream": [{"type": "etag"}, {"type": "compression"}, {"type": "date"}]
+//	  }
+//	}
+//
+// Each stage is an object with a "type" and the parameters for that type.
+// See RegisterFilter for the built in types and for adding your own.
+type Config struct {
+	Pools    map[string]*PoolConfig `json:"pools"`
+	Pipeline *PipelineConfig        `json:"pipeline"`
+}
+
+// Describes a falcore.Pipeline.  Upstream stages may be RequestFilters or
+// Routers.  Downstream and Finally stages must be ResponseFilters.
+type PipelineConfig struct {
+	Upstream   []json.RawMessage `json:"upstream"`
+	Downstream []json.RawMessage `json:"downstream"`
+	Finally    []json.RawMessage `json:"finally"`
+}
+
+// Describes a filter.UpstreamPool.  Balancer is one of round_robin (the
+// default), least_conn, p2c, ewma or hash.  hash requires HashKey, which is
+// "header:<name>", "cookie:<name>" or "path".  Servers may be empty if SRV
+// is set.
+type PoolConfig struct {
+	Servers       []*ServerConfig     `json:"servers"`
+	Timeout       Duration            `json:"timeout"`
+	PingPath      string              `json:"ping_path"`
+	ForceHttp     bool                `json:"force_http"`
+	MaxConcurrent int64               `json:"max_concurrent"`
+	Balancer      string              `json:"balancer"`
+	HashKey       string              `json:"hash_key"`
+	Retry         *RetryConfig        `json:"retry"`
+	Outlier       *OutlierConfig      `json:"outlier_detection"`
+	HealthCheck   *HealthConfig       `json:"health_check"`
+	ProxyHeaders  *ProxyHeadersConfig `json:"proxy_headers"`
+	TLS           *TLSConfig          `json:"tls"`
+	SRV           *SRVConfig          `json:"srv"`
+}
+
+// Describes a filter.SRVDiscovery that adds servers to the pool.  Name is
+// the whole record, like "_http._tcp.app.example.com".
+type SRVConfig struct {
+	Name     string   `json:"name"`
+	Interval Duration `json:"interval"`
+}
+
+// Connects to the pool's servers with TLS.  ServerName defaults to each
+// server's host.  CAFile replaces the system roots.  CertFile and KeyFile
+// are a client certificate for mTLS.  HTTP2 offers h2 to the servers.
+type TLSConfig struct {
+	ServerName         string `json:"server_name"`
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	HTTP2              bool   `json:"http2"`
+}
+
+// Describes a filter.ProxyHeaders.  Unset fields get the defaults from
+// filter.NewProxyHeaders.  Trusted proxies are CIDRs or addresses.
+// Disabled passes the client's forwarding headers through untouched.
+type ProxyHeadersConfig struct {
+	Disabled       bool     `json:"disabled"`
+	TrustedProxies []string `json:"trusted_proxies"`
+	XForwarded     *bool    `json:"x_forwarded"`
+	Forwarded      bool     `json:"forwarded"`
+	Via            *string  `json:"via"`
+}
+
+// Describes a filter.HealthCheck.  It replaces ping_path.  Unset fields
+// get the defaults from filter.NewHealthCheck.  Each expect_status entry
+// is a code like "200", a range like "200-399" or a class like "2xx".
+type HealthConfig struct {
+	Interval     Duration `json:"interval"`
+	Timeout      Duration `json:"timeout"`
+	Rise         int      `json:"rise"`
+	Fall         int      `json:"fall"`
+	TCP          bool     `json:"tcp"`
+	Method       string   `json:"method"`
+	Path         string   `json:"path"`
+	Host         string   `json:"host"`
+	ExpectStatus []string `json:"expect_status"`
+	ExpectBody   string   `json:"expect_body"`
+}
+
+// Describes a filter.OutlierDetection.  Unset fields get the defaults from
+// filter.NewOutlierDetection.  Disabled turns passive health checks off.
+type OutlierConfig struct {
+	Disabled            bool     `json:"disabled"`
+	ConsecutiveFailures *int     `json:"consecutive_failures"`
+	ErrorRate           *float64 `json:"error_rate"`
+	Window              Duration `json:"window"`
+	MinRequests         *int     `json:"min_requests"`
+	BaseEjection        Duration `json:"base_ejection"`
+	MaxEjection         Duration `json:"max_ejection"`
+	MaxEjectionPercent  *int     `json:"max_ejection_percent"`
+}
+
+// Describes a filter.RetryPolicy.  Unset fields get the defaults from
+// filter.NewRetryPolicy.
+type RetryConfig struct {
+	MaxRetries  int      `json:"max_retries"`
+	Backoff     Duration `json:"backoff"`
+	MaxBackoff  Duration `json:"max_backoff"`
+	Budget      *float64 `json:"budget"`
+	BudgetBurst *int     `json:"budget_burst"`
+	MaxBodySize int64    `json:"max_body_size"`
+}
+
+// A single server in an upstream pool.  Weight defaults to 1.
+type ServerConfig struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Weight *int   `json:"weight"`
+}
+
+// A time.Duration that is written as a string like "1.5s" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// A problem found while building a route table.  Path is a JSON path
+// to the offending value such as $.pipeline.upstream[2].pool
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Path, e.Message)
+}
+
+// All the problems found while building a route table
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ve := range e {
+		msgs[i] = ve.Error()
+	}
+	return "config: " + strings.Join(msgs, "; ")
+}
+
+// The result of loading a route table.  Pools holds every UpstreamPool
+// that was created so they can be shut down when the table is replaced.
+type RouteTable struct {
+	Pipeline *falcore.Pipeline
+	Pools    map[string]*filter.UpstreamPool
+}
+
+// Stop the health check goroutines of all the pools in the table.  This
+// should only be called once nothing is using the Pipeline anymore.
+func (t *RouteTable) Shutdown() {
+	for _, pool := range t.Pools {
+		pool.Shutdown()
+	}
+}
+
+// Read a route table from the JSON file at path
+func LoadFile(path string) (*RouteTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Read a route table from r
+func Load(r io.Reader) (*RouteTable, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	conf := new(Config)
+	if err = strictUnmarshal(data, conf); err != nil {
+		if se, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(data[:se.Offset], []byte("\n")) + 1
+			return nil, ValidationErrors{{"$", fmt.Sprintf("line %v: %v", line, se)}}
+		}
+		return nil, ValidationErrors{{"$", err.Error()}}
+	}
+	return Build(conf)
+}
+
+// Build a route table from an already decoded Config
+func Build(conf *Config) (*RouteTable, error) {
+	b := &builder{
+		conf:      conf,
+		table:     &RouteTable{Pools: make(map[string]*filter.UpstreamPool)},
+		upstreams: make(map[string]func(host string, port int) *filter.Upstream),
+	}
+	b.validatePools()
+	if conf.Pipeline == nil {
+		b.fail("$.pipeline", "is required")
+	} else {
+		b.table.Pipeline = b.pipeline("$.pipeline", conf.Pipeline)
+	}
+	if len(b.errs) > 0 {
+		b.table.Shutdown()
+		return nil, b.errs
+	}
+	return b.table, nil
+}
+
+// State for a single Build
+type builder struct {
+	conf  *Config
+	table *RouteTable
+	errs  ValidationErrors
+	// Creates Upstreams with each pool's settings
+	upstreams map[string]func(host string, port int) *filter.Upstream
+}
+
+func (b *builder) fail(path string, format string, args ...interface{}) {
+	b.errs = append(b.errs, &ValidationError{path, fmt.Sprintf(format, args...)})
+}
+
+func (b *builder) validatePools() {
+	names := make([]string, 0, len(b.conf.Pools))
+	for name := range b.conf.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := fmt.Sprintf("$.pools.%v", name)
+		pc := b.conf.Pools[name]
+		if pc == nil || (len(pc.Servers) == 0 && pc.SRV == nil) {
+			b.fail(path+".servers", "at least one server is required")
+			continue
+		}
+		if pc.SRV != nil && pc.SRV.Name == "" {
+			b.fail(path+".srv.name", "is required")
+		}
+		if _, err := newBalancer(pc); err != nil {
+			b.fail(path+err.Path, "%v", err.Message)
+		}
+		if rc := pc.Retry; rc != nil {
+			if rc.MaxRetries < 1 {
+				b.fail(path+".retry.max_retries", "must be at least 1")
+			}
+			if rc.Budget != nil && (*rc.Budget < 0 || *rc.Budget > 1) {
+				b.fail(path+".retry.budget", "must be between 0 and 1")
+			}
+			if rc.BudgetBurst != nil && *rc.BudgetBurst < 0 {
+				b.fail(path+".retry.budget_burst", "must not be negative")
+			}
+		}
+		if hc := pc.HealthCheck; hc != nil {
+			if !hc.TCP && !strings.HasPrefix(hc.Path, "/") {
+				b.fail(path+".health_check.path", "must start with /")
+			}
+			if hc.Rise < 0 {
+				b.fail(path+".health_check.rise", "must not be negative")
+			}
+			if hc.Fall < 0 {
+				b.fail(path+".health_check.fall", "must not be negative")
+			}
+			for i, s := range hc.ExpectStatus {
+				if _, err := filter.ParseStatusRange(s); err != nil {
+					b.fail(fmt.Sprintf("%v.health_check.expect_status[%v]", path, i), "%v", err)
+				}
+			}
+		}
+		if phc := pc.ProxyHeaders; phc != nil {
+			for i, s := range phc.TrustedProxies {
+				if _, err := filter.ParseCIDRs(s); err != nil {
+					b.fail(fmt.Sprintf("%v.proxy_headers.trusted_proxies[%v]", path, i), "%v", err)
+				}
+			}
+		}
+		if tc := pc.TLS; tc != nil {
+			if (tc.CertFile == "") != (tc.KeyFile == "") {
+				b.fail(path+".tls", "cert_file and key_file must be set together")
+			} else if _, err := newUpstreamTLS(tc); err != nil {
+				b.fail(path+".tls", "%v", err)
+			}
+		}
+		if oc := pc.Outlier; oc != nil {
+			if oc.ConsecutiveFailures != nil && *oc.ConsecutiveFailures < 0 {
+				b.fail(path+".outlier_detection.consecutive_failures", "must not be negative")
+			}
+			if oc.ErrorRate != nil && (*oc.ErrorRate < 0 || *oc.ErrorRate > 1) {
+				b.fail(path+".outlier_detection.error_rate", "must be between 0 and 1")
+			}
+			if oc.MaxEjectionPercent != nil && (*oc.MaxEjectionPercent < 0 || *oc.MaxEjectionPercent > 100) {
+				b.fail(path+".outlier_detection.max_ejection_percent", "must be between 0 and 100")
+			}
+		}
+		for i, sc := range pc.Servers {
+			spath := fmt.Sprintf("%v.servers[%v]", path, i)
+			if sc.Host == "" {
+				b.fail(spath+".host", "is required")
+			}
+			if sc.Port <= 0 || sc.Port > 65535 {
+				b.fail(spath+".port", "must be between 1 and 65535")
+			}
+			if sc.Weight != nil && *sc.Weight < 0 {
+				b.fail(spath+".weight", "must not be negative")
+			}
+		}
+	}
+}
+
+// Returns the named pool, creating it the first time it's used so
+// unreferenced pools don't start health checking.
+func (b *builder) pool(path string, name string) *filter.UpstreamPool {
+	if pool, ok := b.table.Pools[name]; ok {
+		return pool
+	}
+	pc, ok := b.conf.Pools[name]
+	if !ok {
+		b.fail(path, "unknown pool %q", name)
+		return nil
+	}
+	if pc == nil || (len(pc.Servers) == 0 && pc.SRV == nil) {
+		// already reported by validatePools
+		return nil
+	}
+	var ph *filter.ProxyHeaders
+	if pc.ProxyHeaders != nil {
+		ph = newProxyHeaders(pc.ProxyHeaders)
+	}
+	var tlsConfig *tls.Config
+	if pc.TLS != nil {
+		// already validated
+		tlsConfig, _ = newUpstreamTLS(pc.TLS)
+	}
+	newUpstream := func(host string, port int) *filter.Upstream {
+		ut := filter.NewUpstreamTransport(host, port, time.Duration(pc.Timeout), nil)
+		if tlsConfig != nil {
+			ut.TLS = tlsConfig
+			ut.HTTP2 = pc.TLS.HTTP2
+		}
+		up := filter.NewUpstream(ut)
+		up.Name = fmt.Sprintf("%v:%v", host, port)
+		up.PingPath = pc.PingPath
+		up.ForceHttp = pc.ForceHttp
+		if pc.ProxyHeaders != nil {
+			up.ProxyHeaders = ph
+		}
+		up.SetMaxConcurrent(pc.MaxConcurrent)
+		return up
+	}
+	b.upstreams[name] = newUpstream
+	entries := make([]*filter.UpstreamEntry, len(pc.Servers))
+	for i, sc := range pc.Servers {
+		up := newUpstream(sc.Host, sc.Port)
+		if sc.Name != "" {
+			up.Name = sc.Name
+		}
+		weight := 1
+		if sc.Weight != nil {
+			weight = *sc.Weight
+		}
+		entries[i] = &filter.UpstreamEntry{Upstream: up, Weight: weight}
+	}
+	pool := filter.NewUpstreamPool(name, entries)
+	// already validated
+	pool.Balancer, _ = newBalancer(pc)
+	if pc.Retry != nil {
+		pool.Retry = newRetryPolicy(pc.Retry)
+	}
+	if pc.Outlier != nil {
+		pool.Outlier = newOutlierDetection(pc.Outlier)
+	}
+	if pc.HealthCheck != nil {
+		pool.SetHealthCheck(newHealthCheck(pc.HealthCheck))
+	}
+	if pc.SRV != nil {
+		d := filter.NewSRVDiscovery("", "", pc.SRV.Name)
+		if pc.SRV.Interval > 0 {
+			d.Interval = time.Duration(pc.SRV.Interval)
+		}
+		d.NewUpstream = newUpstream
+		pool.Discover(d)
+	}
+	b.table.Pools[name] = pool
+	return pool
+}
+
+func (b *builder) pipeline(path string, pc *PipelineConfig) *falcore.Pipeline {
+	pipe := falcore.NewPipeline()
+	for i, raw := range pc.Upstream {
+		spath := fmt.Sprintf("%v.upstream[%v]", path, i)
+		switch f := b.stage(spath, raw).(type) {
+		case nil:
+		case falcore.Router, falcore.RequestFilter:
+			pipe.Upstream.PushBack(f)
+		default:
+			b.fail(spath, "%T is not a RequestFilter or Router", f)
+		}
+	}
+	b.responseFilters(path+".downstream", pc.Downstream, pipe.Downstream)
+	b.responseFilters(path+".finally", pc.Finally, pipe.Finally)
+	return pipe
+}
+
+func (b *builder) responseFilters(path string, raws []json.RawMessage, l *list.List) {
+	for i, raw := range raws {
+		spath := fmt.Sprintf("%v[%v]", path, i)
+		switch f := b.stage(spath, raw).(type) {
+		case nil:
+		case falcore.ResponseFilter, falcore.ResponseFilterE, falcore.ResponseReplacer:
+			l.PushBack(f)
+		default:
+			b.fail(spath, "%T is not a ResponseFilter", f)
+		}
+	}
+}
+
+// Build a stage that must be usable as a RequestFilter, such as a
+// route destination.  Routers are wrapped in a Pipeline.
+func (b *builder) requestFilter(path string, raw json.RawMessage) falcore.RequestFilter {
+	switch f := b.stage(path, raw).(type) {
+	case nil:
+	case falcore.Router:
+		pipe := falcore.NewPipeline()
+		pipe.Upstream.PushBack(f)
+		return pipe
+	case falcore.RequestFilter:
+		return f
+	default:
+		b.fail(path, "%T is not a RequestFilter or Router", f)
+	}
+	return nil
+}
+
+// Build any kind of stage.  Returns nil if there was an error.
+func (b *builder) stage(path string, raw json.RawMessage) interface{} {
+	var st struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &st); err != nil {
+		b.fail(path, "stage must be an object: %v", err)
+		return nil
+	}
+	if st.Type == "" {
+		b.fail(path+".type", "is required")
+		return nil
+	}
+	if bf, ok := builtins[st.Type]; ok {
+		return bf(b, path, raw)
+	}
+	registryM.RLock()
+	factory, ok := registry[st.Type]
+	registryM.RUnlock()
+	if !ok {
+		b.fail(path+".type", "unknown filter type %q", st.Type)
+		return nil
+	}
+	f, err := factory(raw)
+	if err != nil {
+		if ve, ok := err.(*ValidationError); ok {
+			b.fail(path+strings.TrimPrefix(ve.Path, "$"), "%v", ve.Message)
+		} else {
+			b.fail(path, "%v", err)
+		}
+		return nil
+	}
+	return f
+}
+
+// Decode params into v.  Reports unknown fields so typos don't
+// go unnoticed.
+func (b *builder) decode(path string, raw json.RawMessage, v interface{}) bool {
+	if err := strictUnmarshal(raw, v); err != nil {
+		b.fail(path, "%v", err)
+		return false
+	}
+	return true
+}
+
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Errors have a Path relative to the pool
+func newBalancer(pc *PoolConfig) (filter.Balancer, *ValidationError) {
+	if pc.HashKey != "" && pc.Balancer != "hash" {
+		return nil, &ValidationError{".hash_key", "requires the hash balancer"}
+	}
+	switch pc.Balancer {
+	case "", "round_robin":
+		return filter.NewRoundRobinBalancer(), nil
+	case "least_conn":
+		return filter.NewLeastConnBalancer(), nil
+	case "p2c":
+		return filter.NewP2CBalancer(), nil
+	case "ewma":
+		return filter.NewEWMABalancer(), nil
+	case "hash":
+		kind, name, _ := strings.Cut(pc.HashKey, ":")
+		switch {
+		case kind == "header" && name != "":
+			return filter.NewHashBalancer(filter.HeaderHashKey(name)), nil
+		case kind == "cookie" && name != "":
+			return filter.NewHashBalancer(filter.CookieHashKey(name)), nil
+		case pc.HashKey == "path":
+			return filter.NewHashBalancer(filter.PathHashKey()), nil
+		}
+		return nil, &ValidationError{".hash_key", fmt.Sprintf("must be header:<name>, cookie:<name> or path, not %q", pc.HashKey)}
+	}
+	return nil, &ValidationError{".balancer", fmt.Sprintf("unknown balancer %q", pc.Balancer)}
+}
+
+func newRetryPolicy(rc *RetryConfig) *filter.RetryPolicy {
+	p := filter.NewRetryPolicy(rc.MaxRetries)
+	if rc.Backoff > 0 {
+		p.Backoff = time.Duration(rc.Backoff)
+	}
+	if rc.MaxBackoff > 0 {
+		p.MaxBackoff = time.Duration(rc.MaxBackoff)
+	}
+	if rc.Budget != nil {
+		p.Budget = *rc.Budget
+	}
+	if rc.BudgetBurst != nil {
+		p.BudgetBurst = *rc.BudgetBurst
+	}
+	if rc.MaxBodySize > 0 {
+		p.MaxBodySize = rc.MaxBodySize
+	}
+	return p
+}
+
+func newOutlierDetection(oc *OutlierConfig) *filter.OutlierDetection {
+	if oc.Disabled {
+		return nil
+	}
+	od := filter.NewOutlierDetection()
+	if oc.ConsecutiveFailures != nil {
+		od.ConsecutiveFailures = *oc.ConsecutiveFailures
+	}
+	if oc.ErrorRate != nil {
+		od.ErrorRate = *oc.ErrorRate
+	}
+	if oc.Window > 0 {
+		od.Window = time.Duration(oc.Window)
+	}
+	if oc.MinRequests != nil {
+		od.MinRequests = *oc.MinRequests
+	}
+	if oc.BaseEjection > 0 {
+		od.BaseEjection = time.Duration(oc.BaseEjection)
+	}
+	if oc.MaxEjection > 0 {
+		od.MaxEjection = time.Duration(oc.MaxEjection)
+	}
+	if oc.MaxEjectionPercent != nil {
+		od.MaxEjectionPercent = *oc.MaxEjectionPercent
+	}
+	return od
+}
+
+func newUpstreamTLS(tc *TLSConfig) (*tls.Config, error) {
+	config, err := filter.LoadUpstreamTLS(tc.ServerName, tc.CAFile, tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.InsecureSkipVerify = tc.InsecureSkipVerify
+	return config, nil
+}
+
+func newProxyHeaders(phc *ProxyHeadersConfig) *filter.ProxyHeaders {
+	if phc.Disabled {
+		return nil
+	}
+	ph := filter.NewProxyHeaders()
+	// already validated
+	ph.TrustedProxies, _ = filter.ParseCIDRs(phc.TrustedProxies...)
+	if phc.XForwarded != nil {
+		ph.XForwarded = *phc.XForwarded
+	}
+	ph.Forwarded = phc.Forwarded
+	if phc.Via != nil {
+		ph.Via = *phc.Via
+	}
+	return ph
+}
+
+func newHealthCheck(hc *HealthConfig) *filter.HealthCheck {
+	check := filter.NewHealthCheck(hc.Path)
+	check.TCPOnly = hc.TCP
+	check.Host = hc.Host
+	check.ExpectBody = hc.ExpectBody
+	if hc.Interval > 0 {
+		check.Interval = time.Duration(hc.Interval)
+	}
+	if hc.Timeout > 0 {
+		check.Timeout = time.Duration(hc.Timeout)
+	}
+	if hc.Rise > 0 {
+		check.Rise = hc.Rise
+	}
+	if hc.Fall > 0 {
+		check.Fall = hc.Fall
+	}
+	if hc.Method != "" {
+		check.Method = hc.Method
+	}
+	if len(hc.ExpectStatus) > 0 {
+		check.Expect = nil
+		for _, s := range hc.ExpectStatus {
+			// already validated
+			r, _ := filter.ParseStatusRange(s)
+			check.Expect = append(check.Expect, r)
+		}
+	}
+	return check
+}
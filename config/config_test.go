@@ -0,0 +1,253 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/filter"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadRouteTable(t *testing.T) {
+	RegisterFilter("test_hello", func(raw json.RawMessage) (interface{}, error) {
+		var params struct {
+			Type  string `json:"type"`
+			Reply string `json:"reply"`
+		}
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, err
+		}
+		if params.Reply == "" {
+			return nil, &ValidationError{"$.reply", "is required"}
+		}
+		return falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			return falcore.StringResponse(req.HttpRequest, 200, nil, params.Reply)
+		}), nil
+	})
+
+	doc := `{
+		"pipeline": {
+			"upstream": [
+				{"type": "throttle", "rps": 0},
+				{"type": "host_router", "hosts": {
+					"www.example.com": {"type": "path_router", "routes": [
+						{"match": "^/hello", "filter": {"type": "test_hello", "reply": "hello"}},
+						{"match": "^/files/", "filter": {"type": "file", "base_path": "../test", "path_prefix": "/files"}}
+					]}
+				}}
+			],
+			"downstream": [{"type": "etag"}, {"type": "date"}]
+		}
+	}`
+	table, err := Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer table.Shutdown()
+
+	tmp, _ := http.NewRequest("GET", "http://www.example.com/hello", nil)
+	_, res := falcore.TestWithRequest(tmp, table.Pipeline, nil)
+	if res == nil || res.StatusCode != 200 {
+		t.Fatalf("Expected 200 response, got %v", res)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "hello" {
+		t.Errorf("Wrong body: %q", body)
+	}
+	if res.Header.Get("Date") == "" {
+		t.Errorf("Downstream date filter didn't run")
+	}
+
+	tmp, _ = http.NewRequest("GET", "http://other.example.com/hello", nil)
+	if _, res = falcore.TestWithRequest(tmp, table.Pipeline, nil); res != nil {
+		t.Errorf("Expected no response for unknown host, got %v", res.StatusCode)
+	}
+}
+
+func TestLoadValidationErrors(t *testing.T) {
+	doc := `{
+		"pools": {
+			"app": {"servers": [{"host": "localhost", "port": 0}]},
+			"bad": {"servers": [{"host": "localhost", "port": 80}], "balancer": "hash", "hash_key": "query:id",
+				"health_check": {"path": "/ping", "expect_status": ["20x"]},
+				"proxy_headers": {"trusted_proxies": ["10.0.0.0/40"]},
+				"tls": {"ca_file": "../test/missing.pem"}, "srv": {}}
+		},
+		"pipeline": {
+			"upstream": [
+				{"type": "pool", "pool": "missing"},
+				{"type": "path_router", "routes": [{"match": "(", "filter": {"type": "nope"}}]},
+				{"type": "file", "base_pth": "/tmp"},
+				{"type": "date"}
+			],
+			"downstream": [{"type": "throttle"}]
+		}
+	}`
+	_, err := Load(strings.NewReader(doc))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+	expected := []string{
+		"$.pools.app.servers[0].port",
+		"$.pools.bad.srv.name",
+		"$.pools.bad.hash_key",
+		"$.pools.bad.health_check.expect_status[0]",
+		"$.pools.bad.proxy_headers.trusted_proxies[0]",
+		"$.pools.bad.tls",
+		"$.pipeline.upstream[0].pool",
+		"$.pipeline.upstream[1].routes[0].match",
+		"$.pipeline.upstream[1].routes[0].filter.type",
+		"$.pipeline.upstream[2]",
+		"$.pipeline.upstream[3]",
+		"$.pipeline.downstream[0]",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v errors, got %v", len(expected), err)
+	}
+	for i, path := range expected {
+		if errs[i].Path != path {
+			t.Errorf("Error %v: expected path %v got %v", i, path, errs[i])
+		}
+	}
+}
+
+func TestLoadPoolBalancer(t *testing.T) {
+	doc := `{
+		"pools": {"app": {"servers": [{"host": "localhost", "port": 8080}], "balancer": "hash", "hash_key": "cookie:session",
+			"retry": {"max_retries": 2, "backoff": "10ms", "budget": 0.5},
+			"outlier_detection": {"consecutive_failures": 3, "base_ejection": "1m"},
+			"health_check": {"path": "/health", "interval": "1m", "expect_status": ["2xx", "404"], "expect_body": "ok"},
+			"proxy_headers": {"trusted_proxies": ["10.0.0.0/8", "::1"], "forwarded": true, "via": ""},
+			"tls": {"server_name": "app.internal", "http2": true}}},
+		"pipeline": {"upstream": [{"type": "pool", "pool": "app"}]}
+	}`
+	table, err := Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer table.Shutdown()
+	if b, ok := table.Pools["app"].Balancer.(*filter.HashBalancer); !ok || b.KeyFunc == nil {
+		t.Errorf("Expected a HashBalancer with a key, got %T", table.Pools["app"].Balancer)
+	}
+	r := table.Pools["app"].Retry
+	if r == nil || r.MaxRetries != 2 || r.Backoff != 10*time.Millisecond || r.Budget != 0.5 || r.MaxBackoff != time.Second {
+		t.Errorf("Bad retry policy %+v", r)
+	}
+	od := table.Pools["app"].Outlier
+	if od == nil || od.ConsecutiveFailures != 3 || od.BaseEjection != time.Minute || od.MaxEjectionPercent != 50 {
+		t.Errorf("Bad outlier detection %+v", od)
+	}
+	hc := table.Pools["app"].HealthCheck()
+	if hc == nil || hc.Path != "/health" || hc.Interval != time.Minute || hc.Rise != 2 || len(hc.Expect) != 2 || hc.Expect[1].Min != 404 || hc.ExpectBody != "ok" {
+		t.Errorf("Bad health check %+v", hc)
+	}
+	ut := table.Pools["app"].Next().Upstream.Transport
+	if ut.TLS == nil || ut.TLS.ServerName != "app.internal" || !ut.HTTP2 {
+		t.Errorf("Bad TLS %+v", ut.TLS)
+	}
+	ph := table.Pools["app"].Next().Upstream.ProxyHeaders
+	if ph == nil || len(ph.TrustedProxies) != 2 || !ph.XForwarded || !ph.Forwarded || ph.Via != "" {
+		t.Errorf("Bad proxy headers %+v", ph)
+	}
+}
+
+func TestLoadSyntaxError(t *testing.T) {
+	_, err := Load(strings.NewReader("{\n\"pipeline\": {,}}"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected syntax error with line number, got %v", err)
+	}
+}
+
+func TestLoadCircuitBreaker(t *testing.T) {
+	doc := `{
+		"pipeline": {"upstream": [{"type": "circuit_breaker", "name": "files", "open_timeout": "1m", "failure_rate": 0,
+			"filter": {"type": "file", "base_path": "../test"},
+			"fallback": {"type": "throttle", "rps": 0}}]}
+	}`
+	table, err := Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer table.Shutdown()
+	cb, ok := table.Pipeline.Upstream.Front().Value.(*filter.CircuitBreaker)
+	if !ok {
+		t.Fatalf("Expected a CircuitBreaker, got %T", table.Pipeline.Upstream.Front().Value)
+	}
+	if cb.Name != "files" || cb.OpenTimeout != time.Minute || cb.FailureRate != 0 || cb.ConsecutiveFailures != 5 || cb.Fallback == nil {
+		t.Errorf("Bad circuit breaker %+v", cb)
+	}
+
+	_, err = Load(strings.NewReader(`{"pipeline": {"upstream": [{"type": "circuit_breaker", "failure_rate": 2}]}}`))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 2 || errs[0].Path != "$.pipeline.upstream[0].filter" || errs[1].Path != "$.pipeline.upstream[0].failure_rate" {
+		t.Errorf("Expected filter and failure_rate errors, got %v", err)
+	}
+}
+
+// Answers SRV lookups for _http._tcp.app.test
+type srvResolver struct{}
+
+func (srvResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (srvResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if name != "_http._tcp.app.test" {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, []*net.SRV{{Target: "a.test.", Port: 8080, Weight: 5}}, nil
+}
+
+func TestLoadPoolSRV(t *testing.T) {
+	defer func(r filter.Resolver) { filter.DefaultResolver = r }(filter.DefaultResolver)
+	filter.DefaultResolver = srvResolver{}
+
+	doc := `{
+		"pools": {"app": {"srv": {"name": "_http._tcp.app.test", "interval": "1m"}, "max_concurrent": 10}},
+		"pipeline": {"upstream": [{"type": "pool", "pool": "app"}]}
+	}`
+	table, err := Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer table.Shutdown()
+	health := table.Pools["app"].Health()
+	if len(health) != 1 || health[0].Name != "a.test:8080" || health[0].Weight != 5 {
+		t.Fatalf("Bad servers %+v", health)
+	}
+	if up := table.Pools["app"].Next().Upstream; up.MaxConcurrent() != 10 {
+		t.Errorf("Expected the pool's settings, got %v", up.MaxConcurrent())
+	}
+}
+
+func TestLoadPoolAdmin(t *testing.T) {
+	doc := `{
+		"pools": {"app": {"servers": [{"host": "localhost", "port": 8080}], "max_concurrent": 10}},
+		"pipeline": {"upstream": [{"type": "pool_admin", "path_prefix": "/admin", "token": "secret"}]}
+	}`
+	table, err := Load(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer table.Shutdown()
+	pa, ok := table.Pipeline.Upstream.Front().Value.(*filter.PoolAdmin)
+	if !ok || pa.Token != "secret" || pa.Pools["app"] != table.Pools["app"] {
+		t.Fatalf("Bad pool admin %+v", pa)
+	}
+
+	tmp, _ := http.NewRequest("POST", "http://localhost/admin/pools/app/servers", strings.NewReader(`{"host": "localhost", "port": 8081}`))
+	tmp.Header.Set("Authorization", "Bearer secret")
+	if _, res := falcore.TestWithRequest(tmp, pa, nil); res.StatusCode != 201 {
+		t.Fatalf("Expected 201, got %v", res.StatusCode)
+	}
+	entries := table.Pools["app"].Entries()
+	if len(entries) != 2 || entries[1].Upstream.MaxConcurrent() != 10 {
+		t.Errorf("Expected the server to get the pool's settings")
+	}
+}
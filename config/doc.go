@@ -0,0 +1,2 @@
+// Build falcore Pipelines from a declarative JSON route table
+package config
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/fitstar/falcore"
+)
+
+// Keeps a Server running on the route table from a config file.
+// Each Reload builds a new table and swaps it in with Server.SetPipeline.
+// The old table's pools are shut down once its in-flight requests finish.
+// If the new file doesn't build, the server keeps the table it has.
+type Reloader struct {
+	Path    string
+	Server  *falcore.Server
+	current *RouteTable
+	m       sync.Mutex
+}
+
+// Load path and install it as srv's pipeline
+func NewReloader(srv *falcore.Server, path string) (*Reloader, error) {
+	r := &Reloader{Path: path, Server: srv}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Rebuild the route table from Path and swap it in
+func (r *Reloader) Reload() error {
+	table, err := LoadFile(r.Path)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	old := r.current
+	r.current = table
+	r.Server.SetPipeline(table.Pipeline, func(*falcore.Pipeline) {
+		if old != nil {
+			old.Shutdown()
+		}
+	})
+	r.m.Unlock()
+
+	falcore.Info("Loaded route table from %v", r.Path)
+	return nil
+}
+
+// Returns the route table currently installed
+func (r *Reloader) Current() *RouteTable {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.current
+}
+
+// Reload every time one of sigs is received, usually syscall.SIGHUP.
+// Errors are logged and the current table is kept.
+func (r *Reloader) ReloadOn(sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for sig := range c {
+			falcore.Info("Received %v, reloading %v", sig, r.Path)
+			if err := r.Reload(); err != nil {
+				falcore.Error("Failed to reload %v: %v", r.Path, err)
+			}
+		}
+	}()
+}
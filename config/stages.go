@@ -0,0 +1,309 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/filter"
+	"github.com/fitstar/falcore/router"
+)
+
+// Creates a custom stage from its JSON object.  raw is the whole stage
+// object, including "type".  The result must be a falcore.RequestFilter,
+// falcore.Router or falcore.ResponseFilter depending on where the stage
+// is used.  Return a *ValidationError with a path relative to the stage
+// (like "$.limit") to point at a specific field.
+type FilterFactory func(raw json.RawMessage) (interface{}, error)
+
+var registry = make(map[string]FilterFactory)
+var registryM = new(sync.RWMutex)
+
+// Make a custom filter available to route tables under name.
+// Panics if name is already registered or is a built in type.
+//
+// The built in types are:
+//
+//	pipeline     {"upstream": [...], "downstream": [...]}
+//	host_router  {"hosts": {"example.com": stage, ...}}
+//	path_router  {"routes": [{"match": "^/regexp", "filter": stage}, ...]}
+//	pool         {"pool": "name"}  an UpstreamPool from "pools"
+//	pool_admin   {"path_prefix": "/admin", "token": "secret", "pools": ["name", ...]}
+//	             a filter.PoolAdmin for the listed pools, or all of them
+//	file         {"base_path": "/var/www", "path_prefix": "", "directory_index": "index.html"}
+//	throttle     {"rps": 100}
+//	circuit_breaker  {"filter": stage, "fallback": stage, "consecutive_failures": 5,
+//	                  "failure_rate": 0.5, "window": "10s", "min_requests": 20,
+//	                  "open_timeout": "30s", "half_open_requests": 3}
+//	compression  {"types": ["text/html", ...]}  (downstream)
+//	etag         {}  (downstream)
+//	date         {}  (downstream)
+func RegisterFilter(name string, factory FilterFactory) {
+	registryM.Lock()
+	defer registryM.Unlock()
+	if _, ok := builtins[name]; ok {
+		panic(fmt.Sprintf("config: %v is a built in filter type", name))
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("config: filter type %v registered twice", name))
+	}
+	registry[name] = factory
+}
+
+type builtinFactory func(b *builder, path string, raw json.RawMessage) interface{}
+
+var builtins map[string]builtinFactory
+
+func init() {
+	builtins = map[string]builtinFactory{
+		"pipeline":        buildPipeline,
+		"host_router":     buildHostRouter,
+		"path_router":     buildPathRouter,
+		"pool":            buildPool,
+		"pool_admin":      buildPoolAdmin,
+		"file":            buildFile,
+		"throttle":        buildThrottle,
+		"circuit_breaker": buildCircuitBreaker,
+		"compression":     buildCompression,
+		"etag":            buildEtag,
+		"date":            buildDate,
+	}
+}
+
+// Every built in params struct embeds this so "type" isn't an unknown field
+type stageType struct {
+	Type string `json:"type"`
+}
+
+func buildPipeline(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		PipelineConfig
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	return b.pipeline(path, &params.PipelineConfig)
+}
+
+func buildHostRouter(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		Hosts map[string]json.RawMessage `json:"hosts"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	hosts := make([]string, 0, len(params.Hosts))
+	for host := range params.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	hr := router.NewHostRouter()
+	for _, host := range hosts {
+		if f := b.requestFilter(fmt.Sprintf("%v.hosts[%q]", path, host), params.Hosts[host]); f != nil {
+			hr.AddMatch(host, f)
+		}
+	}
+	return hr
+}
+
+func buildPathRouter(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		Routes []struct {
+			Match  string          `json:"match"`
+			Filter json.RawMessage `json:"filter"`
+		} `json:"routes"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	pr := router.NewPathRouter()
+	for i, route := range params.Routes {
+		rpath := fmt.Sprintf("%v.routes[%v]", path, i)
+		re, err := regexp.Compile(route.Match)
+		if err != nil {
+			b.fail(rpath+".match", "%v", err)
+		}
+		if route.Filter == nil {
+			b.fail(rpath+".filter", "is required")
+			continue
+		}
+		if f := b.requestFilter(rpath+".filter", route.Filter); f != nil && err == nil {
+			pr.AddRoute(&router.RegexpRoute{Match: re, Filter: f})
+		}
+	}
+	return pr
+}
+
+func buildPool(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		Pool string `json:"pool"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	if pool := b.pool(path+".pool", params.Pool); pool != nil {
+		return pool
+	}
+	return nil
+}
+
+func buildPoolAdmin(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		PathPrefix string   `json:"path_prefix"`
+		Token      string   `json:"token"`
+		Pools      []string `json:"pools"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	names := params.Pools
+	if names == nil {
+		for name := range b.conf.Pools {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	pools := make(map[string]*filter.UpstreamPool, len(names))
+	for i, name := range names {
+		if pool := b.pool(fmt.Sprintf("%v.pools[%v]", path, i), name); pool != nil {
+			pools[name] = pool
+		}
+	}
+	pa := filter.NewPoolAdmin(params.PathPrefix, pools)
+	pa.Token = params.Token
+	upstreams := b.upstreams
+	pa.NewUpstream = func(pool, host string, port int) *filter.Upstream {
+		return upstreams[pool](host, port)
+	}
+	return pa
+}
+
+func buildFile(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		BasePath       string `json:"base_path"`
+		PathPrefix     string `json:"path_prefix"`
+		DirectoryIndex string `json:"directory_index"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	if params.BasePath == "" {
+		b.fail(path+".base_path", "is required")
+		return nil
+	}
+	return &filter.FileFilter{
+		BasePath:       params.BasePath,
+		PathPrefix:     params.PathPrefix,
+		DirectoryIndex: params.DirectoryIndex,
+	}
+}
+
+func buildThrottle(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		RPS int `json:"rps"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	if params.RPS < 0 {
+		b.fail(path+".rps", "must not be negative")
+		return nil
+	}
+	return filter.NewThrottler(params.RPS)
+}
+
+func buildCircuitBreaker(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		Name                string          `json:"name"`
+		Filter              json.RawMessage `json:"filter"`
+		Fallback            json.RawMessage `json:"fallback"`
+		ConsecutiveFailures *int            `json:"consecutive_failures"`
+		FailureRate         *float64        `json:"failure_rate"`
+		Window              Duration        `json:"window"`
+		MinRequests         *int            `json:"min_requests"`
+		OpenTimeout         Duration        `json:"open_timeout"`
+		HalfOpenRequests    int             `json:"half_open_requests"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	var f falcore.RequestFilter
+	if params.Filter == nil {
+		b.fail(path+".filter", "is required")
+	} else {
+		f = b.requestFilter(path+".filter", params.Filter)
+	}
+	if params.FailureRate != nil && (*params.FailureRate < 0 || *params.FailureRate > 1) {
+		b.fail(path+".failure_rate", "must be between 0 and 1")
+	}
+	var fallback falcore.RequestFilter
+	if params.Fallback != nil {
+		fallback = b.requestFilter(path+".fallback", params.Fallback)
+	}
+	if f == nil {
+		return nil
+	}
+	name := params.Name
+	if name == "" {
+		name = path
+	}
+	cb := filter.NewCircuitBreaker(name, f, fallback)
+	if params.ConsecutiveFailures != nil {
+		cb.ConsecutiveFailures = *params.ConsecutiveFailures
+	}
+	if params.FailureRate != nil {
+		cb.FailureRate = *params.FailureRate
+	}
+	if params.Window > 0 {
+		cb.Window = time.Duration(params.Window)
+	}
+	if params.MinRequests != nil {
+		cb.MinRequests = *params.MinRequests
+	}
+	if params.OpenTimeout > 0 {
+		cb.OpenTimeout = time.Duration(params.OpenTimeout)
+	}
+	if params.HalfOpenRequests > 0 {
+		cb.HalfOpenRequests = params.HalfOpenRequests
+	}
+	return cb
+}
+
+func buildCompression(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct {
+		stageType
+		Types []string `json:"types"`
+	}
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	return filter.NewCompressionFilter(params.Types)
+}
+
+func buildEtag(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct{ stageType }
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	return new(filter.EtagFilter)
+}
+
+func buildDate(b *builder, path string, raw json.RawMessage) interface{} {
+	var params struct{ stageType }
+	if !b.decode(path, raw, &params) {
+		return nil
+	}
+	return new(filter.DateFilter)
+}
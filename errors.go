@@ -0,0 +1,148 @@
+package falcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An error that carries the HTTP status it should be reported with.
+// Message is shown to the client.  Cause is only logged so it's safe
+// to put internal details there.
+//
+// Errors that aren't (and don't wrap) an *HTTPError are reported as a
+// 500 with a generic message.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+	Cause      error
+}
+
+// Generate a new HTTPError.  If message is empty, the standard
+// status text is used.  cause may be nil.
+func NewHTTPError(status int, message string, cause error) *HTTPError {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &HTTPError{StatusCode: status, Message: message, Cause: cause}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%d %s: %v", e.StatusCode, e.Message, e.Cause)
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Cause
+}
+
+// Returns err as an *HTTPError.  Errors that don't carry a status
+// become a 500.
+func AsHTTPError(err error) *HTTPError {
+	var he *HTTPError
+	if errors.As(err, &he) {
+		return he
+	}
+	return NewHTTPError(500, "", err)
+}
+
+// Generates the response sent to the client for an error returned
+// from a filter.
+type ErrorRenderer func(req *Request, err error) *http.Response
+
+// Generate a response for err using the ErrorRenderer of the innermost
+// Pipeline the request is running in that has one, or DefaultErrorRenderer.
+// Useful for filters that want consistent error pages but have to return
+// a response.
+func RenderError(req *Request, err error) *http.Response {
+	if req.errorRenderer != nil {
+		return req.errorRenderer(req, err)
+	}
+	return DefaultErrorRenderer(req, err)
+}
+
+// Renders the error based on the request's Accept header as
+// application/problem+json (RFC 7807), application/json, text/html
+// or text/plain.  text/plain is used if nothing else is acceptable.
+func DefaultErrorRenderer(req *Request, err error) *http.Response {
+	he := AsHTTPError(err)
+	headers := make(http.Header)
+	var body []byte
+	switch negotiateErrorType(req.HttpRequest.Header.Get("Accept")) {
+	case "application/problem+json":
+		headers.Set("Content-Type", "application/problem+json")
+		body, _ = json.Marshal(map[string]interface{}{
+			"type":   "about:blank",
+			"title":  http.StatusText(he.StatusCode),
+			"status": he.StatusCode,
+			"detail": he.Message,
+		})
+		body = append(body, '\n')
+	case "application/json":
+		headers.Set("Content-Type", "application/json")
+		body, _ = json.Marshal(map[string]interface{}{
+			"status": he.StatusCode,
+			"error":  he.Message,
+		})
+		body = append(body, '\n')
+	case "text/html":
+		headers.Set("Content-Type", "text/html; charset=utf-8")
+		buf := new(bytes.Buffer)
+		title := html.EscapeString(strconv.Itoa(he.StatusCode) + " " + http.StatusText(he.StatusCode))
+		fmt.Fprintf(buf, "<html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>\n",
+			title, title, html.EscapeString(he.Message))
+		body = buf.Bytes()
+	default:
+		headers.Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(he.Message + "\n")
+	}
+	return ByteResponse(req.HttpRequest, he.StatusCode, headers, body)
+}
+
+var errorTypes = []string{"application/problem+json", "application/json", "text/html", "text/plain"}
+
+// Picks the error content type with the highest q value in accept.
+// Ties go to the first listed.  Wildcards match text/plain.
+func negotiateErrorType(accept string) string {
+	type mediaRange struct {
+		mt string
+		q  float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mt, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	for _, r := range ranges {
+		for _, t := range errorTypes {
+			if r.mt == t {
+				return t
+			}
+		}
+		if r.mt == "*/*" || r.mt == "text/*" {
+			return "text/plain"
+		}
+	}
+	return "text/plain"
+}
@@ -0,0 +1,108 @@
+package falcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateErrorType(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", "text/plain"},
+		{"*/*", "text/plain"},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "text/html"},
+		{"application/json", "application/json"},
+		{"application/json;q=0.5, application/problem+json", "application/problem+json"},
+		{"image/png", "text/plain"},
+		{"text/html;q=0, application/json;q=0.1", "application/json"},
+	}
+	for _, test := range tests {
+		if got := negotiateErrorType(test.accept); got != test.expected {
+			t.Errorf("%q: expected %v got %v", test.accept, test.expected, got)
+		}
+	}
+}
+
+func TestDefaultErrorRenderer(t *testing.T) {
+	req := validGetRequest()
+	req.HttpRequest.Header.Set("Accept", "application/problem+json")
+	res := DefaultErrorRenderer(req, NewHTTPError(404, "no such widget", nil))
+	if res.StatusCode != 404 || res.Header.Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("Bad response: %v %v", res.StatusCode, res.Header)
+	}
+	var problem map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&problem); err != nil {
+		t.Fatalf("Bad JSON: %v", err)
+	}
+	if problem["status"] != 404.0 || problem["detail"] != "no such widget" || problem["title"] != "Not Found" {
+		t.Errorf("Bad problem: %v", problem)
+	}
+
+	// Untyped errors are a 500 and don't leak the message
+	req.HttpRequest.Header.Set("Accept", "text/html")
+	res = DefaultErrorRenderer(req, errors.New("database password is hunter2"))
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 500 || strings.Contains(string(body), "hunter2") {
+		t.Errorf("Bad response: %v %s", res.StatusCode, body)
+	}
+
+	// Wrapped HTTPErrors keep their status
+	wrapped := fmt.Errorf("loading: %w", NewHTTPError(403, "", nil))
+	if res = DefaultErrorRenderer(req, wrapped); res.StatusCode != 403 {
+		t.Errorf("Expected 403, got %v", res.StatusCode)
+	}
+}
+
+func TestPipelineErrorFilters(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilterE(func(req *Request) (*http.Response, error) {
+		return nil, NewHTTPError(401, "", nil)
+	}))
+
+	outer := NewPipeline()
+	outer.ErrorRenderer = func(req *Request, err error) *http.Response {
+		return StringResponse(req.HttpRequest, AsHTTPError(err).StatusCode, nil, "custom: "+err.Error())
+	}
+	outer.Upstream.PushBack(inner)
+	outer.Downstream.PushBack(NewResponseFilterE(func(req *Request, res *http.Response) error {
+		if res.StatusCode == 401 {
+			res.Header.Set("WWW-Authenticate", "Basic")
+		}
+		return nil
+	}))
+
+	req := validGetRequest()
+	res := outer.execute(req)
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 401 || string(body) != "custom: 401 Unauthorized" {
+		t.Errorf("Bad response: %v %q", res.StatusCode, body)
+	}
+	if res.Header.Get("WWW-Authenticate") != "Basic" {
+		t.Errorf("Downstream filters didn't run after error")
+	}
+	if pss := req.PipelineStageStats.Front().Value.(*PipelineStageStat); pss.Status != 2 {
+		t.Errorf("Failed stage should have status 2, got %v", pss.Status)
+	}
+}
+
+func TestResponseFilterError(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	p.Downstream.PushBack(NewResponseFilterE(func(req *Request, res *http.Response) error {
+		return NewHTTPError(502, "upstream sent garbage", nil)
+	}))
+	res := p.execute(validGetRequest())
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 502 || string(body) != "upstream sent garbage\n" {
+		t.Errorf("Bad response: %v %q", res.StatusCode, body)
+	}
+}
@@ -0,0 +1,74 @@
+package falcoretest
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+)
+
+// The default remote address for Run
+const DefaultRemoteAddr = "192.0.2.1:12345"
+
+// An in-memory net.Conn.  Reads come from In and writes, such as a
+// 100 Continue, are collected in Out.  Deadlines are ignored.
+type Conn struct {
+	Local  *net.TCPAddr
+	Remote *net.TCPAddr
+
+	mu     sync.Mutex
+	In     bytes.Buffer
+	Out    bytes.Buffer
+	closed bool
+}
+
+// Generate a new Conn from remoteAddr, an "ip:port".  Panics if the
+// address is invalid.
+func NewConn(remoteAddr string) *Conn {
+	remote, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		panic(err)
+	}
+	return &Conn{
+		Local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+		Remote: remote,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.In.Read(p)
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.Out.Write(p)
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Whether Close has been called
+func (c *Conn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.Local }
+func (c *Conn) RemoteAddr() net.Addr               { return c.Remote }
+func (c *Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
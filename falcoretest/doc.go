@@ -0,0 +1,2 @@
+// Helpers for testing falcore Pipelines and Servers in memory
+package falcoretest
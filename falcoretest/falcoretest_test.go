@@ -0,0 +1,102 @@
+package falcoretest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/router"
+)
+
+var userKey = falcore.NewKey[string]("user")
+
+func testPipeline() *falcore.Pipeline {
+	hello := falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		user, _ := userKey.Get(req)
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "hello "+user+" from "+req.RemoteAddr.IP.String())
+	})
+	r := router.NewPathRouter()
+	r.AddMatch("^/hello", hello)
+
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(r)
+	p.Downstream.PushBack(falcore.NewResponseFilter(func(req *falcore.Request, res *http.Response) {
+		res.Header.Set("X-Downstream", "yes")
+	}))
+	return p
+}
+
+func TestRun(t *testing.T) {
+	p := testPipeline()
+	Run(t, p, httptest.NewRequest("GET", "/hello", nil), userKey.Value("bob")).
+		Status(200).
+		Header("X-Downstream", "yes").
+		Body("hello bob from 192.0.2.1").
+		Stages("*router.PathRouter", "*falcore.genericRequestFilter", "*falcore.genericResponseFilter").
+		Stage("*router.PathRouter", 0)
+
+	// Routers fall through to the server's 404, which still goes downstream
+	Run(t, p, httptest.NewRequest("GET", "/nope", nil)).
+		Status(404).
+		Header("X-Downstream", "yes").
+		BodyContains("Not Found")
+
+	rec := RunConn(t, p, httptest.NewRequest("GET", "/hello", nil), NewConn("[2001:db8::1]:80"))
+	rec.BodyContains("2001:db8::1")
+}
+
+// Failed assertions are reported to the test
+type fakeT struct {
+	testing.TB
+	errors int
+}
+
+func (f *fakeT) Helper()                                   {}
+func (f *fakeT) Errorf(format string, args ...interface{}) { f.errors++ }
+
+func TestRecorderFailures(t *testing.T) {
+	ft := &fakeT{TB: t}
+	Run(ft, testPipeline(), httptest.NewRequest("GET", "/hello", nil)).
+		Status(500).
+		Header("X-Missing", "x").
+		NoHeader("X-Downstream").
+		Body("nope").
+		BodyContains("nope").
+		Stages("nope").
+		Stage("nope", 0)
+	if ft.errors != 7 {
+		t.Errorf("Expected 7 failures, got %v", ft.errors)
+	}
+
+	// A key with no values is missing
+	ft = &fakeT{TB: t}
+	r := Run(ft, testPipeline(), httptest.NewRequest("GET", "/hello", nil))
+	r.Response.Header["X-Empty"] = []string{}
+	r.Header("X-Empty", "")
+	if ft.errors != 1 {
+		t.Errorf("Expected 1 failure, got %v", ft.errors)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer(t, testPipeline())
+	for i := 0; i < 2; i++ {
+		res, err := srv.Client.Get("/hello?x=1")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 || string(body) != "hello  from 127.0.0.1" {
+			t.Errorf("Bad response: %v %q", res.StatusCode, body)
+		}
+	}
+	start := time.Now()
+	srv.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took too long: %v", d)
+	}
+}
@@ -0,0 +1,131 @@
+package falcoretest
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fitstar/falcore"
+)
+
+// The result of running a request through a Pipeline in memory.  The
+// assertion methods report failures to the test they were created with
+// and return the Recorder so they can be chained:
+//
+//	falcoretest.Run(t, pipeline, httptest.NewRequest("GET", "/", nil)).
+//		Status(200).
+//		Header("Content-Type", "text/plain").
+//		Body("hello")
+type Recorder struct {
+	Request  *falcore.Request
+	Response *http.Response
+	// The whole response body.  Response.Body has been read and closed.
+	RawBody []byte
+	t       testing.TB
+}
+
+// Run req through pipeline the way the Server does, using a Conn from
+// DefaultRemoteAddr.  Routers, Downstream and Finally filters all run and a
+// request nothing responds to gets the Server's 404.
+func Run(t testing.TB, pipeline *falcore.Pipeline, req *http.Request, values ...falcore.KeyValue) *Recorder {
+	t.Helper()
+	return RunConn(t, pipeline, req, NewConn(DefaultRemoteAddr), values...)
+}
+
+// Like Run with a specific connection
+func RunConn(t testing.TB, pipeline *falcore.Pipeline, req *http.Request, conn net.Conn, values ...falcore.KeyValue) *Recorder {
+	t.Helper()
+	freq, res := falcore.TestWithPipeline(req, pipeline, conn, values...)
+	rec := &Recorder{Request: freq, Response: res, t: t}
+	if res.Body != nil {
+		var err error
+		if rec.RawBody, err = ioutil.ReadAll(res.Body); err != nil {
+			t.Errorf("Error reading body: %v", err)
+		}
+		res.Body.Close()
+	}
+	return rec
+}
+
+// Assert the status code
+func (r *Recorder) Status(code int) *Recorder {
+	r.t.Helper()
+	if r.Response.StatusCode != code {
+		r.t.Errorf("Expected status %v, got %v", code, r.Response.StatusCode)
+	}
+	return r
+}
+
+// Assert a response header's value
+func (r *Recorder) Header(name, value string) *Recorder {
+	r.t.Helper()
+	if got := r.Response.Header[http.CanonicalHeaderKey(name)]; len(got) == 0 {
+		r.t.Errorf("Expected header %v: %q, it's missing", name, value)
+	} else if got[0] != value {
+		r.t.Errorf("Expected header %v: %q, got %q", name, value, got[0])
+	}
+	return r
+}
+
+// Assert a response header isn't set
+func (r *Recorder) NoHeader(name string) *Recorder {
+	r.t.Helper()
+	if got := r.Response.Header.Get(name); got != "" {
+		r.t.Errorf("Expected no %v header, got %q", name, got)
+	}
+	return r
+}
+
+// Assert the whole body
+func (r *Recorder) Body(body string) *Recorder {
+	r.t.Helper()
+	if string(r.RawBody) != body {
+		r.t.Errorf("Expected body %q, got %q", body, r.RawBody)
+	}
+	return r
+}
+
+// Assert the body contains s
+func (r *Recorder) BodyContains(s string) *Recorder {
+	r.t.Helper()
+	if !strings.Contains(string(r.RawBody), s) {
+		r.t.Errorf("Expected body to contain %q, got %q", s, r.RawBody)
+	}
+	return r
+}
+
+// The names of the PipelineStageStats, in order
+func (r *Recorder) StageNames() []string {
+	var names []string
+	for e := r.Request.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		names = append(names, e.Value.(*falcore.PipelineStageStat).Name)
+	}
+	return names
+}
+
+// Assert the exact list of stage names
+func (r *Recorder) Stages(names ...string) *Recorder {
+	r.t.Helper()
+	got := r.StageNames()
+	if strings.Join(got, "\n") != strings.Join(names, "\n") {
+		r.t.Errorf("Expected stages %q, got %q", names, got)
+	}
+	return r
+}
+
+// Assert a stage named name ran with status
+func (r *Recorder) Stage(name string, status byte) *Recorder {
+	r.t.Helper()
+	for e := r.Request.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		if pss := e.Value.(*falcore.PipelineStageStat); pss.Name == name {
+			if pss.Status != status {
+				r.t.Errorf("Expected stage %v to have status %v, got %v", name, status, pss.Status)
+			}
+			return r
+		}
+	}
+	r.t.Errorf("Expected stage %v, got %q", name, r.StageNames())
+	return r
+}
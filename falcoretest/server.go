@@ -0,0 +1,102 @@
+package falcoretest
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// A falcore.Server running in the test process on a random loopback port
+type Server struct {
+	Server *falcore.Server
+	// http://127.0.0.1:port
+	URL string
+	// A client for the server.  Requests with a relative URL, such as
+	// Client.Get("/hello"), are sent to the server.
+	Client *http.Client
+
+	done chan error
+}
+
+// Start a server for pipeline.  It's stopped when the test finishes.
+func NewServer(t testing.TB, pipeline *falcore.Pipeline) *Server {
+	t.Helper()
+	return Start(t, falcore.NewServer(0, pipeline))
+}
+
+// Start srv, which can be configured first.  If it has no port, it
+// listens on a random loopback port.  It's stopped when the test finishes.
+// ListenerTimeout is shortened so stopping doesn't hold up the test.
+func Start(t testing.TB, srv *falcore.Server) *Server {
+	t.Helper()
+	if srv.Addr == "" || srv.Addr == ":0" {
+		srv.Addr = "127.0.0.1:0"
+	}
+	if srv.ListenerTimeout > 100*time.Millisecond {
+		srv.ListenerTimeout = 100 * time.Millisecond
+	}
+	s := &Server{Server: srv, done: make(chan error, 1)}
+	go func() {
+		s.done <- srv.ListenAndServe()
+	}()
+	select {
+	case <-srv.AcceptReady:
+	case err := <-s.done:
+		t.Fatalf("Could not start falcore: %v", err)
+	}
+	s.URL = "http://127.0.0.1:" + strconv.Itoa(srv.Port())
+	base, _ := url.Parse(s.URL)
+	s.Client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &relativeTransport{base: base, rt: &http.Transport{}},
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Stop the server and wait for it to finish.  Safe to call more than once.
+func (s *Server) Close() {
+	if s.done == nil {
+		return
+	}
+	s.Client.CloseIdleConnections()
+	s.Server.StopAccepting()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+	}
+	s.done = nil
+}
+
+// Sends requests with no host to base
+type relativeTransport struct {
+	base *url.URL
+	rt   http.RoundTripper
+}
+
+func (t *relativeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "" {
+		r := req.Clone(req.Context())
+		u := *t.base
+		u.Path = req.URL.Path
+		if !strings.HasPrefix(u.Path, "/") {
+			u.Path = "/" + u.Path
+		}
+		u.RawQuery = req.URL.RawQuery
+		r.URL = &u
+		r.Host = u.Host
+		req = r
+	}
+	return t.rt.RoundTrip(req)
+}
+
+func (t *relativeTransport) CloseIdleConnections() {
+	if ci, ok := t.rt.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,215 @@
+package falcore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"time"
+)
+
+// One of the filters run by a FanOutFilter
+type FanOutBranch struct {
+	// Used for the stage stat and in FanOutResult.  Defaults to the
+	// type of Filter.
+	Name   string
+	Filter RequestFilter
+	// Per branch deadline.  0 means only the request's own deadline applies.
+	Timeout time.Duration
+}
+
+// The outcome of one FanOutBranch.  Err is set if the branch returned an
+// error, panicked or ran out of time (a 504 *HTTPError).  Response may be
+// nil if the filter didn't return one.
+type FanOutResult struct {
+	Name     string
+	Response *http.Response
+	Err      error
+}
+
+// Combines the results of every branch, in the order of
+// FanOutFilter.Branches, into one response.  A returned error is rendered
+// with RenderError.
+type FanOutMerge func(req *Request, results []FanOutResult) (*http.Response, error)
+
+// A RequestFilter that runs all of its Branches concurrently and combines
+// their responses with Merge.  Each branch gets its own copy of the Request,
+// like TimeoutFilter, so branches must not modify Context or HttpRequest
+// headers.
+//
+// Each branch is recorded as its own PipelineStageStat, named after the
+// branch, after the stats of any nested Pipeline it ran.  Branches that
+// fail or time out have Status 2 (Fail).  The call to Merge is recorded
+// last, under the FanOutFilter's type.
+//
+// Response bodies Merge doesn't return are closed after it returns.
+type FanOutFilter struct {
+	Branches []FanOutBranch
+	Merge    FanOutMerge
+}
+
+func NewFanOutFilter(merge FanOutMerge, branches ...FanOutBranch) *FanOutFilter {
+	return &FanOutFilter{Branches: branches, Merge: merge}
+}
+
+func (f *FanOutFilter) FilterRequest(req *Request) *http.Response {
+	res, err := f.FilterRequestE(req)
+	if err != nil {
+		return req.filterError(err)
+	}
+	return res
+}
+
+type fanOutBranchRun struct {
+	child  *Request
+	stage  *PipelineStageStat
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan FanOutResult
+}
+
+// Implements RequestFilterE
+func (f *FanOutFilter) FilterRequestE(req *Request) (*http.Response, error) {
+	runs := make([]*fanOutBranchRun, len(f.Branches))
+	for i, b := range f.Branches {
+		run := new(fanOutBranchRun)
+		if b.Timeout > 0 {
+			run.ctx, run.cancel = context.WithTimeout(req.HttpRequest.Context(), b.Timeout)
+		} else {
+			run.ctx, run.cancel = context.WithCancel(req.HttpRequest.Context())
+		}
+		run.child = req.fork(run.ctx)
+		run.stage = NewPiplineStage(b.name())
+		run.stage.Type = PipelineStageTypeUpstream
+		run.done = make(chan FanOutResult, 1)
+		runs[i] = run
+		go func(run *fanOutBranchRun, b FanOutBranch) {
+			run.done <- run.execute(b)
+		}(run, b)
+	}
+
+	results := make([]FanOutResult, len(runs))
+	for i, run := range runs {
+		select {
+		case results[i] = <-run.done:
+			req.join(run.child)
+			// Gave up without a response because it ran out of time
+			if r := &results[i]; r.Response == nil && r.Err == nil && run.ctx.Err() != nil {
+				r.Err = NewHTTPError(504, "", run.ctx.Err())
+				run.stage.Status = 2 // Fail
+			}
+		case <-run.ctx.Done():
+			// Clean up whenever it does finish
+			go func(done chan FanOutResult) {
+				if r := <-done; r.Response != nil && r.Response.Body != nil {
+					r.Response.Body.Close()
+				}
+			}(run.done)
+			// The branch still owns run.stage
+			pss := NewPiplineStage(run.stage.Name)
+			pss.StartTime = run.stage.StartTime
+			pss.Type = PipelineStageTypeUpstream
+			pss.Status = 2 // Fail
+			run.stage = pss
+			results[i] = FanOutResult{
+				Name: pss.Name,
+				Err:  NewHTTPError(504, "", run.ctx.Err()),
+			}
+		}
+		run.cancel()
+		req.appendPipelineStage(run.stage)
+	}
+
+	// The merge is a stage of its own so errors are attributed to it
+	req.startPipelineStage(reflect.TypeOf(f).String())
+	req.CurrentStage.Type = PipelineStageTypeUpstream
+	defer req.finishPipelineStage()
+	res, err := f.Merge(req, results)
+	// The stage is finished before the error is rendered, so it's marked
+	// failed here for the Signature
+	if err != nil && req.CurrentStage.Status == 0 {
+		req.CurrentStage.Status = 2 // Fail
+	}
+	for _, r := range results {
+		if r.Response != nil && r.Response.Body != nil && (res == nil || r.Response.Body != res.Body) {
+			r.Response.Body.Close()
+		}
+	}
+	return res, err
+}
+
+// Implements PipelineBrancher.  Every branch runs, so each is labelled
+// with its name.
+func (f *FanOutFilter) PipelineBranches() []PipelineBranch {
+	branches := make([]PipelineBranch, len(f.Branches))
+	for i, b := range f.Branches {
+		branches[i] = PipelineBranch{Label: b.name(), Filter: b.Filter}
+	}
+	return branches
+}
+
+func (b FanOutBranch) name() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return reflect.TypeOf(b.Filter).String()
+}
+
+// Runs the branch on its own Request.  The branch's stage is the child's
+// CurrentStage so plain filters can set its Status.
+func (run *fanOutBranchRun) execute(b FanOutBranch) (result FanOutResult) {
+	child, pss := run.child, run.stage
+	child.CurrentStage = pss
+	result.Name = pss.Name
+	defer func() {
+		if err := recover(); err != nil {
+			Error("%s PANIC in %s: %v\n%s", child.ID, pss.Name, err, debug.Stack())
+			result.Response = nil
+			result.Err = NewHTTPError(500, "", fmt.Errorf("panic: %v", err))
+		}
+		if result.Err != nil && pss.Status == 0 {
+			pss.Status = 2 // Fail
+		}
+		pss.EndTime = time.Now()
+	}()
+	if fe, ok := b.Filter.(RequestFilterE); ok {
+		result.Response, result.Err = fe.FilterRequestE(child)
+	} else {
+		result.Response = b.Filter.FilterRequest(child)
+	}
+	return
+}
+
+// A FanOutMerge that combines JSON response bodies into one object keyed by
+// branch name.  Branches that fail, don't respond, or don't respond with a
+// 2xx are null.  Responds with 502 if every branch fails.
+func MergeJSON(req *Request, results []FanOutResult) (*http.Response, error) {
+	merged := make(map[string]json.RawMessage, len(results))
+	ok := 0
+	for _, r := range results {
+		merged[r.Name] = json.RawMessage("null")
+		if r.Err != nil || r.Response == nil || r.Response.StatusCode/100 != 2 || r.Response.Body == nil {
+			continue
+		}
+		body, err := ioutil.ReadAll(r.Response.Body)
+		if err != nil || !json.Valid(body) {
+			Warn("%s Bad JSON from %s: %v", req.ID, r.Name, err)
+			continue
+		}
+		merged[r.Name] = body
+		ok++
+	}
+	if ok == 0 && len(results) > 0 {
+		return nil, NewHTTPError(502, "", fmt.Errorf("all %d branches failed", len(results)))
+	}
+	body, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return StringResponse(req.HttpRequest, 200, header, string(body)), nil
+}
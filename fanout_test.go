@@ -0,0 +1,116 @@
+package falcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func jsonFilter(body string, delay time.Duration) RequestFilter {
+	return NewRequestFilter(func(req *Request) *http.Response {
+		select {
+		case <-time.After(delay):
+		case <-req.HttpRequest.Context().Done():
+			return nil
+		}
+		return StringResponse(req.HttpRequest, 200, nil, body)
+	})
+}
+
+func TestFanOutFilter(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(jsonFilter(`{"id":2}`, 0))
+
+	f := NewFanOutFilter(MergeJSON,
+		FanOutBranch{Name: "user", Filter: jsonFilter(`{"id":1}`, 20*time.Millisecond)},
+		FanOutBranch{Name: "account", Filter: inner},
+		FanOutBranch{Name: "slow", Filter: jsonFilter(`{}`, time.Second), Timeout: 10 * time.Millisecond},
+		FanOutBranch{Name: "broken", Filter: NewRequestFilter(func(req *Request) *http.Response {
+			panic("boom")
+		})},
+	)
+	p := NewPipeline()
+	p.Upstream.PushBack(f)
+
+	req := validGetRequest()
+	start := time.Now()
+	res := p.execute(req)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Branches didn't run concurrently: %v", d)
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("Bad JSON: %v", err)
+	}
+	if body["user"].(map[string]interface{})["id"] != 1.0 || body["account"].(map[string]interface{})["id"] != 2.0 {
+		t.Errorf("Bad body: %v", body)
+	}
+	if body["slow"] != nil || body["broken"] != nil {
+		t.Errorf("Failed branches should be null: %v", body)
+	}
+
+	// Nested pipeline stage, one stage per branch, then the fan out itself
+	expected := []struct {
+		name   string
+		status byte
+	}{
+		{"user", 0},
+		{"*falcore.genericRequestFilter", 0},
+		{"account", 0},
+		{"slow", 2},
+		{"broken", 2},
+		{"*falcore.FanOutFilter", 0},
+	}
+	if req.PipelineStageStats.Len() != len(expected) {
+		t.Fatalf("Expected %v stages, got %v", len(expected), req.PipelineStageStats.Len())
+	}
+	e := req.PipelineStageStats.Front()
+	for _, exp := range expected {
+		pss := e.Value.(*PipelineStageStat)
+		if pss.Name != exp.name || pss.Status != exp.status {
+			t.Errorf("Expected stage %v/%v, got %v/%v", exp.name, exp.status, pss.Name, pss.Status)
+		}
+		e = e.Next()
+	}
+}
+
+func TestFanOutAllFailed(t *testing.T) {
+	f := NewFanOutFilter(MergeJSON, FanOutBranch{Filter: NewRequestFilterE(func(req *Request) (*http.Response, error) {
+		return nil, NewHTTPError(503, "", nil)
+	}).(RequestFilter)})
+	p := NewPipeline()
+	p.Upstream.PushBack(f)
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 502 {
+		t.Errorf("Expected 502, got %v", res.StatusCode)
+	}
+	if pss := req.PipelineStageStats.Back().Value.(*PipelineStageStat); pss.Name != "*falcore.FanOutFilter" || pss.Status != 2 {
+		t.Errorf("Expected the merge stage to fail, got %v/%v", pss.Name, pss.Status)
+	}
+	// The Signature must include the final statuses
+	h := crc32.NewIEEE()
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		pss := e.Value.(*PipelineStageStat)
+		h.Write([]byte(pss.Name))
+		h.Write([]byte{pss.Status})
+	}
+	if sig := fmt.Sprintf("%X", h.Sum32()); req.Signature() != sig {
+		t.Errorf("Expected signature %v, got %v", sig, req.Signature())
+	}
+}
+
+func TestFanOutBranches(t *testing.T) {
+	f := NewFanOutFilter(MergeJSON,
+		FanOutBranch{Name: "a", Filter: jsonFilter("{}", 0)},
+		FanOutBranch{Filter: NewPipeline()},
+	)
+	p := NewPipeline()
+	p.Upstream.PushBack(f)
+	node := InspectPipeline(p).Upstream[0]
+	if len(node.Branches) != 2 || node.Branches[0].Label != "a" || node.Branches[1].Node.Kind != PipelineNodePipeline {
+		t.Errorf("Bad branches: %+v", node.Branches)
+	}
+}
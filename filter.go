@@ -30,6 +30,45 @@ func (f *genericRequestFilter) FilterRequest(req *Request) *http.Response {
 	return f.f(req)
 }
 
+// An optional form of RequestFilter that can fail.  The Pipeline prefers
+// FilterRequestE when a filter implements both.  When an error is returned,
+// the Pipeline marks the stage failed, logs the error and generates the
+// response with its ErrorRenderer.  Use an *HTTPError to control the status.
+type RequestFilterE interface {
+	FilterRequestE(req *Request) (*http.Response, error)
+}
+
+// Helper to create a Filter that can fail by just passing in a func.
+// The result is also a RequestFilter that renders errors with RenderError
+// so it may be used anywhere a RequestFilter is expected.
+//    filter = NewRequestFilterE(func(req *Request) (*http.Response, error) {
+//			if req.HttpRequest.Header.Get("Authorization") == "" {
+//				return nil, NewHTTPError(401, "", nil)
+//			}
+//			return nil, nil
+//		})
+func NewRequestFilterE(f func(req *Request) (*http.Response, error)) RequestFilterE {
+	rf := new(genericRequestFilterE)
+	rf.f = f
+	return rf
+}
+
+type genericRequestFilterE struct {
+	f func(req *Request) (*http.Response, error)
+}
+
+func (f *genericRequestFilterE) FilterRequestE(req *Request) (*http.Response, error) {
+	return f.f(req)
+}
+
+func (f *genericRequestFilterE) FilterRequest(req *Request) *http.Response {
+	res, err := f.f(req)
+	if err != nil {
+		return RenderError(req, err)
+	}
+	return res
+}
+
 // Filter outgoing responses. This can be used to modify the response
 // before it is sent.  Modifying the request at this point will have no
 // effect.
@@ -55,3 +94,48 @@ type genericResponseFilter struct {
 func (f *genericResponseFilter) FilterResponse(req *Request, res *http.Response) {
 	f.f(req, res)
 }
+
+// An optional form of ResponseFilter that can fail.  If an error is
+// returned, the response is replaced with one from the Pipeline's
+// ErrorRenderer and the remaining Downstream filters still run.
+type ResponseFilterE interface {
+	FilterResponseE(req *Request, res *http.Response) error
+}
+
+// Helper to create a ResponseFilterE by just passing in a func
+func NewResponseFilterE(f func(req *Request, res *http.Response) error) ResponseFilterE {
+	rf := new(genericResponseFilterE)
+	rf.f = f
+	return rf
+}
+
+type genericResponseFilterE struct {
+	f func(req *Request, res *http.Response) error
+}
+
+func (f *genericResponseFilterE) FilterResponseE(req *Request, res *http.Response) error {
+	return f.f(req, res)
+}
+
+// An optional form of ResponseFilter that can swap the response for a new
+// one.  Return nil to keep res.  A replacement is what the remaining
+// Downstream filters see and what the Pipeline returns.  The old body is
+// closed unless the replacement reuses it.
+type ResponseReplacer interface {
+	ReplaceResponse(req *Request, res *http.Response) *http.Response
+}
+
+// Helper to create a ResponseReplacer by just passing in a func
+func NewResponseReplacer(f func(req *Request, res *http.Response) *http.Response) ResponseReplacer {
+	rf := new(genericResponseReplacer)
+	rf.f = f
+	return rf
+}
+
+type genericResponseReplacer struct {
+	f func(req *Request, res *http.Response) *http.Response
+}
+
+func (f *genericResponseReplacer) ReplaceResponse(req *Request, res *http.Response) *http.Response {
+	return f.f(req, res)
+}
@@ -0,0 +1,448 @@
+package filter
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// Chooses which server in an UpstreamPool gets a request.  servers holds
+// the healthy servers with a Weight above 0, or all of the servers with a
+// Weight above 0 if none are healthy.  It's never empty.  req is nil when
+// the server is requested through UpstreamPool.Next.
+//
+// Pick is called concurrently and must be goroutine safe.  A Balancer
+// belongs to a single pool.  The pool is locked for reading during Pick so
+// it can read each server's Weight, but it mustn't call the pool's
+// methods.
+type Balancer interface {
+	Pick(req *falcore.Request, servers []*UpstreamEntry) *UpstreamEntry
+}
+
+// Balancers that implement this are told how each request went.  latency
+// is the time until the response headers arrived.  err is the error from
+// the Upstream, if any.
+type BalancerObserver interface {
+	Observe(ue *UpstreamEntry, latency time.Duration, err error)
+}
+
+// Balancers that keep state for each server implement this so it can be
+// dropped when a server leaves the pool
+type BalancerForgetter interface {
+	Forget(ue *UpstreamEntry)
+}
+
+// The number of requests sent to the server or waiting on its throttle
+func (u *Upstream) outstanding() int64 {
+	u.throttleC.L.Lock()
+	n := u.throttleInFlight + u.throttleQueue
+	u.throttleC.L.Unlock()
+	return n
+}
+
+// Returns the number of requests currently being sent to upstream.  Requests
+// waiting on throttling aren't included.  See QueueLength.
+func (u *Upstream) InFlight() int64 {
+	u.throttleC.L.Lock()
+	n := u.throttleInFlight
+	u.throttleC.L.Unlock()
+	return n
+}
+
+// Whether a is less loaded than b, taking Weight into account
+func lessLoaded(a, b *UpstreamEntry, loadA, loadB float64) bool {
+	return loadA*float64(b.Weight) < loadB*float64(a.Weight)
+}
+
+// Smooth weighted round-robin, as in nginx.  Each server is chosen Weight
+// times per cycle, interleaved rather than in runs.  This is the default.
+type RoundRobinBalancer struct {
+	mutex sync.Mutex
+	state map[*UpstreamEntry]*rrState
+	picks uint64
+}
+
+type rrState struct {
+	currentWeight int
+	// The pick this server was last a candidate for
+	lastPick uint64
+}
+
+func NewRoundRobinBalancer() *RoundRobinBalancer {
+	return &RoundRobinBalancer{state: make(map[*UpstreamEntry]*rrState)}
+}
+
+// Each candidate's currentWeight grows by its Weight and the largest is
+// chosen and reduced by the total.  A server that missed the last pick,
+// such as one that was down, starts over so it doesn't get a burst of
+// requests when it comes back.
+func (b *RoundRobinBalancer) Pick(req *falcore.Request, servers []*UpstreamEntry) *UpstreamEntry {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.picks++
+	var best *rrState
+	var bestUE *UpstreamEntry
+	total := 0
+	for _, ue := range servers {
+		s := b.state[ue]
+		if s == nil {
+			s = new(rrState)
+			b.state[ue] = s
+		}
+		if s.lastPick != b.picks-1 {
+			s.currentWeight = 0
+		}
+		s.lastPick = b.picks
+		s.currentWeight += ue.Weight
+		total += ue.Weight
+		if best == nil || s.currentWeight > best.currentWeight {
+			best, bestUE = s, ue
+		}
+	}
+	best.currentWeight -= total
+	return bestUE
+}
+
+// Implements BalancerForgetter
+func (b *RoundRobinBalancer) Forget(ue *UpstreamEntry) {
+	b.mutex.Lock()
+	delete(b.state, ue)
+	b.mutex.Unlock()
+}
+
+// Sends each request to the server with the fewest outstanding requests
+// relative to its Weight.  Ties go round-robin.
+type LeastConnBalancer struct {
+	mutex sync.Mutex
+	next  int
+}
+
+func NewLeastConnBalancer() *LeastConnBalancer {
+	return new(LeastConnBalancer)
+}
+
+func (b *LeastConnBalancer) Pick(req *falcore.Request, servers []*UpstreamEntry) *UpstreamEntry {
+	b.mutex.Lock()
+	start := b.next
+	b.next++
+	b.mutex.Unlock()
+
+	var best *UpstreamEntry
+	var bestLoad float64
+	for i := range servers {
+		ue := servers[(start+i)%len(servers)]
+		load := float64(ue.Upstream.outstanding())
+		if best == nil || lessLoaded(ue, best, load, bestLoad) {
+			best, bestLoad = ue, load
+		}
+	}
+	return best
+}
+
+// Power of two choices.  Picks two servers at random and sends the request
+// to the one with fewer outstanding requests relative to its Weight.  This
+// is nearly as good as LeastConnBalancer without looking at every server,
+// and doesn't send every new request to the same idle server.
+type P2CBalancer struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func NewP2CBalancer() *P2CBalancer {
+	return &P2CBalancer{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *P2CBalancer) Pick(req *falcore.Request, servers []*UpstreamEntry) *UpstreamEntry {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	b.mutex.Lock()
+	i := b.rand.Intn(len(servers))
+	j := b.rand.Intn(len(servers) - 1)
+	b.mutex.Unlock()
+	if j >= i {
+		j++
+	}
+	a, c := servers[i], servers[j]
+	if lessLoaded(c, a, float64(c.Upstream.outstanding()), float64(a.Upstream.outstanding())) {
+		return c
+	}
+	return a
+}
+
+// Sends each request to the server with the lowest expected latency.  Each
+// server's latency is a peak exponentially weighted moving average: a
+// sample slower than the average replaces it right away, and faster ones
+// bring it down gradually.  It's multiplied by the server's outstanding
+// requests plus one and divided by its Weight.  Servers without any samples
+// yet, such as ones just added to the pool, start out with InitialLatency
+// so they share the load rather than getting every request until their
+// first response.
+type EWMABalancer struct {
+	// How quickly old samples stop mattering.  A sample's weight halves
+	// about every 0.7 Decay.  Defaults to 10s.
+	Decay time.Duration
+	// Failed requests count as at least this slow so a server that fails
+	// fast doesn't attract traffic.  Defaults to 1s.
+	ErrorPenalty time.Duration
+	// The latency of a server without samples.  0, the default, uses the
+	// mean of the servers that have them.
+	InitialLatency time.Duration
+	mutex          sync.Mutex
+	stats          map[*UpstreamEntry]*ewmaStat
+	next           int
+}
+
+type ewmaStat struct {
+	latency float64 // seconds
+	updated time.Time
+}
+
+func NewEWMABalancer() *EWMABalancer {
+	return &EWMABalancer{
+		Decay:        10 * time.Second,
+		ErrorPenalty: time.Second,
+		stats:        make(map[*UpstreamEntry]*ewmaStat),
+	}
+}
+
+func (b *EWMABalancer) Pick(req *falcore.Request, servers []*UpstreamEntry) *UpstreamEntry {
+	b.mutex.Lock()
+	start := b.next
+	b.next++
+	latencies := make([]float64, len(servers))
+	var sum float64
+	sampled := 0
+	for i, ue := range servers {
+		if s := b.stats[ue]; s != nil {
+			latencies[i] = s.latency
+			sum += s.latency
+			sampled++
+		} else {
+			latencies[i] = -1
+		}
+	}
+	b.mutex.Unlock()
+
+	if sampled < len(servers) {
+		// With no samples at all any latency will do, as long as
+		// outstanding requests still count
+		initial := 1.0
+		if b.InitialLatency > 0 {
+			initial = b.InitialLatency.Seconds()
+		} else if sampled > 0 {
+			initial = sum / float64(sampled)
+		}
+		for i := range latencies {
+			if latencies[i] < 0 {
+				latencies[i] = initial
+			}
+		}
+	}
+
+	var best *UpstreamEntry
+	var bestScore float64
+	for n := range servers {
+		i := (start + n) % len(servers)
+		ue := servers[i]
+		score := latencies[i] * float64(ue.Upstream.outstanding()+1)
+		if best == nil || lessLoaded(ue, best, score, bestScore) {
+			best, bestScore = ue, score
+		}
+	}
+	return best
+}
+
+// Implements BalancerObserver
+func (b *EWMABalancer) Observe(ue *UpstreamEntry, latency time.Duration, err error) {
+	if err != nil && latency < b.ErrorPenalty {
+		latency = b.ErrorPenalty
+	}
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := b.stats[ue]
+	if s == nil {
+		b.stats[ue] = &ewmaStat{latency: latency.Seconds(), updated: now}
+		return
+	}
+	if sample := latency.Seconds(); sample > s.latency {
+		s.latency = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(s.updated)) / float64(b.Decay))
+		s.latency = s.latency*w + sample*(1-w)
+	}
+	s.updated = now
+}
+
+// Implements BalancerForgetter
+func (b *EWMABalancer) Forget(ue *UpstreamEntry) {
+	b.mutex.Lock()
+	delete(b.stats, ue)
+	b.mutex.Unlock()
+}
+
+// Returns the key used to choose a server in a HashBalancer.  Requests with
+// the same key go to the same server while it's healthy.  An empty key
+// means the server is picked at random.
+type HashKeyFunc func(req *falcore.Request) string
+
+// Use the value of the named header as the hash key
+func HeaderHashKey(name string) HashKeyFunc {
+	return func(req *falcore.Request) string {
+		return req.HttpRequest.Header.Get(name)
+	}
+}
+
+// Use the value of the named cookie as the hash key
+func CookieHashKey(name string) HashKeyFunc {
+	return func(req *falcore.Request) string {
+		if c, err := req.HttpRequest.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+}
+
+// Use the request path as the hash key
+func PathHashKey() HashKeyFunc {
+	return func(req *falcore.Request) string {
+		return req.HttpRequest.URL.Path
+	}
+}
+
+// The number of points each unit of Weight gets on a HashBalancer's ring
+const hashReplicas = 100
+
+// Consistent hashing for cache affinity.  Each server gets Weight * 100
+// points on a hash ring and a request goes to the server owning the first
+// point at or after the hash of its key.  The ring covers every server in
+// the pool.  Points owned by servers that are down or were already tried
+// are skipped, so when a server goes down or comes back only the keys it
+// owns move, and a retry goes to the same server for the same key.
+type HashBalancer struct {
+	KeyFunc HashKeyFunc
+	mutex   sync.Mutex
+	ring    *hashRing
+}
+
+// The ring for one set of servers.  Replaced as a whole when they or their
+// weights change.
+type hashRing struct {
+	servers []*UpstreamEntry
+	weights []int
+	points  []uint64
+	owners  []*UpstreamEntry
+}
+
+// Implemented by Balancers that need every server in the pool, not just
+// the ones they can choose from
+type poolBalancer interface {
+	pickFrom(req *falcore.Request, all, servers []*UpstreamEntry) *UpstreamEntry
+}
+
+func NewHashBalancer(keyFunc HashKeyFunc) *HashBalancer {
+	return &HashBalancer{KeyFunc: keyFunc}
+}
+
+func (b *HashBalancer) Pick(req *falcore.Request, servers []*UpstreamEntry) *UpstreamEntry {
+	return b.pickFrom(req, servers, servers)
+}
+
+// Walks the ring for all from the key's point to the first owner in
+// servers
+func (b *HashBalancer) pickFrom(req *falcore.Request, all, servers []*UpstreamEntry) *UpstreamEntry {
+	var h uint64
+	var key string
+	if req != nil && b.KeyFunc != nil {
+		key = b.KeyFunc(req)
+	}
+	if key != "" {
+		h = hashString(key)
+	} else {
+		h = rand.Uint64()
+	}
+	candidates := make(map[*UpstreamEntry]bool, len(servers))
+	for _, ue := range servers {
+		candidates[ue] = true
+	}
+	ring := b.ringFor(all)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= h })
+	for n := 0; n < len(ring.points); n++ {
+		if owner := ring.owners[(i+n)%len(ring.points)]; candidates[owner] {
+			return owner
+		}
+	}
+	// Only if servers aren't in all
+	return servers[0]
+}
+
+func (b *HashBalancer) ringFor(servers []*UpstreamEntry) *hashRing {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.ring == nil || !b.ring.matches(servers) {
+		b.ring = newHashRing(servers)
+	}
+	return b.ring
+}
+
+func newHashRing(servers []*UpstreamEntry) *hashRing {
+	r := &hashRing{
+		servers: append([]*UpstreamEntry(nil), servers...),
+		weights: make([]int, len(servers)),
+	}
+	type point struct {
+		hash  uint64
+		owner *UpstreamEntry
+	}
+	var points []point
+	for i, ue := range servers {
+		r.weights[i] = ue.Weight
+		name := ue.Upstream.Name
+		if name == "" {
+			name = ue.Upstream.Transport.host + ":" + strconv.Itoa(ue.Upstream.Transport.port)
+		}
+		for j := 0; j < ue.Weight*hashReplicas; j++ {
+			points = append(points, point{hashString(name + "-" + strconv.Itoa(j)), ue})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	r.points = make([]uint64, len(points))
+	r.owners = make([]*UpstreamEntry, len(points))
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.owners[i] = p.owner
+	}
+	return r
+}
+
+func (r *hashRing) matches(servers []*UpstreamEntry) bool {
+	if len(servers) != len(r.servers) {
+		return false
+	}
+	for i, ue := range servers {
+		if ue != r.servers[i] || ue.Weight != r.weights[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FNV-1a with a final mix so similar keys spread over the whole ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
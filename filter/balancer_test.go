@@ -0,0 +1,212 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+func pickNames(b Balancer, req *falcore.Request, servers []*UpstreamEntry, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[b.Pick(req, servers).Upstream.Name]++
+	}
+	return counts
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	pool, entries := testPool(1, 1, 2)
+	defer pool.Shutdown()
+	entries[0].Upstream.throttleInFlight = 3
+	entries[1].Upstream.throttleInFlight = 2
+	entries[2].Upstream.throttleQueue = 3
+
+	// c has the most outstanding but twice the weight
+	if counts := pickNames(NewLeastConnBalancer(), nil, entries, 10); counts["c"] != 10 {
+		t.Errorf("Expected c every time, got %v", counts)
+	}
+
+	// Ties are spread out
+	entries[0].Upstream.throttleInFlight = 0
+	entries[1].Upstream.throttleInFlight = 0
+	if counts := pickNames(NewLeastConnBalancer(), nil, entries[:2], 10); counts["a"] != 5 {
+		t.Errorf("Expected ties to alternate, got %v", counts)
+	}
+}
+
+func TestP2CBalancer(t *testing.T) {
+	pool, entries := testPool(1, 1, 1)
+	defer pool.Shutdown()
+	entries[0].Upstream.throttleInFlight = 5
+
+	// a loses every comparison
+	counts := pickNames(NewP2CBalancer(), nil, entries, 200)
+	if counts["a"] != 0 || counts["b"] == 0 || counts["c"] == 0 {
+		t.Errorf("Bad distribution %v", counts)
+	}
+	if ue := NewP2CBalancer().Pick(nil, entries[:1]); ue != entries[0] {
+		t.Errorf("Expected the only server")
+	}
+}
+
+func TestEWMABalancer(t *testing.T) {
+	pool, entries := testPool(1, 1, 1)
+	defer pool.Shutdown()
+	b := NewEWMABalancer()
+	b.Observe(entries[0], 100*time.Millisecond, nil)
+	b.Observe(entries[1], 10*time.Millisecond, nil)
+
+	// c counts as average, so b is still faster
+	if ue := b.Pick(nil, entries); ue != entries[1] {
+		t.Errorf("Expected the fastest server, got %v", ue.Upstream.Name)
+	}
+	entries[1].Upstream.throttleInFlight = 9
+	if ue := b.Pick(nil, entries); ue != entries[2] {
+		t.Errorf("Expected the server without samples, got %v", ue.Upstream.Name)
+	}
+	entries[1].Upstream.throttleInFlight = 0
+	b.Observe(entries[2], 50*time.Millisecond, nil)
+	if ue := b.Pick(nil, entries); ue != entries[1] {
+		t.Errorf("Expected the fastest server, got %v", ue.Upstream.Name)
+	}
+
+	// Fast failures aren't attractive
+	b.Observe(entries[1], time.Millisecond, fmt.Errorf("refused"))
+	if ue := b.Pick(nil, entries); ue != entries[2] {
+		t.Errorf("Expected errors to be penalized, got %v", ue.Upstream.Name)
+	}
+
+	// Outstanding requests count against a server
+	entries[2].Upstream.throttleInFlight = 2
+	if ue := b.Pick(nil, entries); ue != entries[0] {
+		t.Errorf("Expected the least busy server, got %v", ue.Upstream.Name)
+	}
+}
+
+func TestEWMABalancerNewServer(t *testing.T) {
+	pool, entries := testPool(1, 1, 1)
+	defer pool.Shutdown()
+	b := NewEWMABalancer()
+	b.Observe(entries[0], 50*time.Millisecond, nil)
+	b.Observe(entries[1], 50*time.Millisecond, nil)
+
+	// 30 requests in flight at once.  c was just added and has no samples.
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		ue := b.Pick(nil, entries)
+		ue.Upstream.throttleInFlight++
+		counts[ue.Upstream.Name]++
+	}
+	if counts["c"] > 15 || counts["a"] == 0 || counts["b"] == 0 {
+		t.Errorf("Expected the new server to share the load, got %v", counts)
+	}
+
+	// Before any samples, outstanding requests still count
+	b = NewEWMABalancer()
+	entries[0].Upstream.throttleInFlight = 5
+	entries[1].Upstream.throttleInFlight = 0
+	if counts := pickNames(b, nil, entries[:2], 1); counts["a"] != 0 {
+		t.Errorf("Expected the less busy server, got %v", counts)
+	}
+}
+
+func TestHashBalancer(t *testing.T) {
+	pool, entries := testPool(1, 1, 2)
+	defer pool.Shutdown()
+	b := NewHashBalancer(HeaderHashKey("X-User"))
+
+	owners := make(map[string]*UpstreamEntry)
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("user%v", i)
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		tmp.Header.Set("X-User", key)
+		req := &falcore.Request{HttpRequest: tmp}
+		ue := b.Pick(req, entries)
+		if again := b.Pick(req, entries); again != ue {
+			t.Fatalf("Key %v moved from %v to %v", key, ue.Upstream.Name, again.Upstream.Name)
+		}
+		owners[key] = ue
+		counts[ue.Upstream.Name]++
+	}
+	// Roughly in proportion to weight
+	if counts["c"] < 800 || counts["a"] < 350 || counts["b"] < 350 {
+		t.Errorf("Bad distribution %v", counts)
+	}
+
+	// Only a's keys move when it's gone
+	for key, owner := range owners {
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		tmp.Header.Set("X-User", key)
+		ue := b.Pick(&falcore.Request{HttpRequest: tmp}, entries[1:])
+		if owner != entries[0] && ue != owner {
+			t.Fatalf("Key %v moved from %v to %v", key, owner.Upstream.Name, ue.Upstream.Name)
+		}
+	}
+
+	// No key is random
+	if counts := pickNames(b, nil, entries, 200); len(counts) != 3 {
+		t.Errorf("Expected keyless requests to be spread, got %v", counts)
+	}
+}
+
+func TestUpstreamPoolBalancer(t *testing.T) {
+	pool, entries := testPool(1, 1, 1)
+	defer pool.Shutdown()
+	pool.Balancer = NewHashBalancer(PathHashKey())
+
+	tmp, _ := http.NewRequest("GET", "/some/path", nil)
+	req := &falcore.Request{HttpRequest: tmp}
+	owner := pool.pick(req, nil)
+	pool.setUp(entries[0], false)
+	pool.setUp(entries[1], false)
+	pool.setUp(entries[2], false)
+	pool.setUp(owner, true)
+	for i := 0; i < 10; i++ {
+		if ue := pool.pick(req, nil); ue != owner {
+			t.Fatalf("Expected %v, got %v", owner.Upstream.Name, ue.Upstream.Name)
+		}
+	}
+}
+
+func TestHashBalancerRetries(t *testing.T) {
+	pool, entries := testPool(1, 1, 1)
+	defer pool.Shutdown()
+	b := NewHashBalancer(PathHashKey())
+	pool.Balancer = b
+
+	tmp, _ := http.NewRequest("GET", "/some/path", nil)
+	req := &falcore.Request{HttpRequest: tmp}
+	owner := pool.pick(req, nil)
+	ring := b.ring
+
+	// Retries skip the tried server but always go to the same one
+	next := pool.pick(req, map[*UpstreamEntry]bool{owner: true})
+	if next == owner {
+		t.Fatalf("Expected a server that wasn't tried")
+	}
+	for i := 0; i < 10; i++ {
+		if ue := pool.pick(req, map[*UpstreamEntry]bool{owner: true}); ue != next {
+			t.Fatalf("Expected %v, got %v", next.Upstream.Name, ue.Upstream.Name)
+		}
+	}
+
+	// Going down doesn't rebuild the ring either
+	pool.setUp(next, false)
+	if ue := pool.pick(req, map[*UpstreamEntry]bool{owner: true}); ue == owner || ue == next {
+		t.Errorf("Expected the third server, got %v", ue.Upstream.Name)
+	}
+	if b.ring != ring {
+		t.Errorf("Expected the ring to be reused")
+	}
+
+	// Changing a weight does
+	pool.SetWeight(entries[0], 2)
+	pool.pick(req, nil)
+	if b.ring == ring {
+		t.Errorf("Expected a new ring")
+	}
+}
@@ -0,0 +1,139 @@
+package filter
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/fitstar/falcore"
+)
+
+// Creates one stage of a body transformation.  Everything written to the
+// returned io.WriteCloser is transformed and written to w.  Close must flush
+// any buffered output to w but must not close w.  gzip.NewWriter is a good
+// example.
+type BodyTransform func(w io.Writer) (io.WriteCloser, error)
+
+// Size of the chunks read from the original body
+const bodyTransformChunk = 32 * 1024
+
+var bodyTransformBufs = sync.Pool{
+	New: func() interface{} { return make([]byte, bodyTransformChunk) },
+}
+
+// Replace res.Body with a reader that streams the original body through
+// transforms, in order.  The work is done as the body is read, while the
+// response is being written, so no goroutine or full buffering is needed.
+//
+// The new length is unknown so res.ContentLength is set to -1 and any
+// Content-Length header is removed.  The server will use chunked encoding.
+// Read errors from the original body and errors from the transforms are
+// returned by Read, which aborts writing the response to the client.
+//
+// If a transform can't be created, res is left untouched.
+func TransformBody(res *http.Response, transforms ...BodyTransform) error {
+	if res.Body == nil || len(transforms) == 0 {
+		return nil
+	}
+	tr := &transformReader{src: res.Body}
+	tr.chain = make([]io.WriteCloser, len(transforms))
+	var w io.Writer = &tr.out
+	for i := len(transforms) - 1; i >= 0; i-- {
+		wc, err := transforms[i](w)
+		if err != nil {
+			return err
+		}
+		tr.chain[i] = wc
+		w = wc
+	}
+	res.Body = tr
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	res.TransferEncoding = nil
+	return nil
+}
+
+// A ResponseFilter that applies Transforms to every response body for which
+// Condition returns true.  A nil Condition matches every response.
+type BodyTransformFilter struct {
+	Condition  func(req *falcore.Request, res *http.Response) bool
+	Transforms []BodyTransform
+}
+
+func NewBodyTransformFilter(condition func(req *falcore.Request, res *http.Response) bool, transforms ...BodyTransform) *BodyTransformFilter {
+	return &BodyTransformFilter{Condition: condition, Transforms: transforms}
+}
+
+func (f *BodyTransformFilter) FilterResponse(request *falcore.Request, res *http.Response) {
+	if res.Body == nil || (f.Condition != nil && !f.Condition(request, res)) {
+		request.CurrentStage.Status = 1 // Skip
+		return
+	}
+	if err := TransformBody(res, f.Transforms...); err != nil {
+		falcore.Error("%s Error starting body transform: %v", request.ID, err)
+		request.CurrentStage.Status = 2 // Fail
+	}
+}
+
+// Pulls the original body through the transform chain as it's read
+type transformReader struct {
+	src   io.ReadCloser
+	chain []io.WriteCloser
+	out   bytes.Buffer
+	buf   []byte
+	err   error
+}
+
+func (r *transformReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && r.err == nil {
+		r.fill()
+	}
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+// Push the next chunk of the original body into the chain
+func (r *transformReader) fill() {
+	if r.buf == nil {
+		r.buf = bodyTransformBufs.Get().([]byte)
+	}
+	n, err := r.src.Read(r.buf)
+	if n > 0 {
+		if _, werr := r.chain[0].Write(r.buf[:n]); werr != nil {
+			r.fail(werr)
+			return
+		}
+	}
+	if err == io.EOF {
+		// Flush each stage into the next
+		for _, wc := range r.chain {
+			if cerr := wc.Close(); cerr != nil {
+				r.fail(cerr)
+				return
+			}
+		}
+		r.fail(io.EOF)
+	} else if err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *transformReader) fail(err error) {
+	r.err = err
+	r.releaseBuf()
+}
+
+func (r *transformReader) releaseBuf() {
+	if r.buf != nil {
+		bodyTransformBufs.Put(r.buf)
+		r.buf = nil
+	}
+}
+
+func (r *transformReader) Close() error {
+	r.releaseBuf()
+	return r.src.Close()
+}
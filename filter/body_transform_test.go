@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fitstar/falcore"
+)
+
+// Upper cases everything written to it
+type upperWriter struct {
+	w io.Writer
+}
+
+func (u *upperWriter) Write(p []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(p))
+}
+
+func (u *upperWriter) Close() error { return nil }
+
+func upperTransform(w io.Writer) (io.WriteCloser, error) {
+	return &upperWriter{w}, nil
+}
+
+func gzipTransform(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func TestTransformBodyChain(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	body := strings.Repeat("hello world ", 10000)
+	res := falcore.StringResponse(req, 200, nil, body)
+	res.Header.Set("Content-Length", "120000")
+
+	if err := TransformBody(res, upperTransform, gzipTransform); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if res.ContentLength != -1 || res.Header.Get("Content-Length") != "" {
+		t.Errorf("Length not cleared: %v %v", res.ContentLength, res.Header)
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("Bad gzip: %v", err)
+	}
+	out, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+	if string(out) != strings.ToUpper(body) {
+		t.Errorf("Body mismatch: got %v bytes", len(out))
+	}
+	res.Body.Close()
+}
+
+type errorReader struct{}
+
+func (errorReader) Read(p []byte) (int, error) { return 0, errors.New("broken body") }
+func (errorReader) Close() error               { return nil }
+
+func TestTransformBodyErrors(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	// Errors reading the original body are returned
+	res := falcore.StringResponse(req, 200, nil, "")
+	res.Body = errorReader{}
+	TransformBody(res, upperTransform)
+	if _, err := ioutil.ReadAll(res.Body); err == nil || err.Error() != "broken body" {
+		t.Errorf("Expected body error, got %v", err)
+	}
+
+	// So are errors creating a transform, leaving res alone
+	res = falcore.StringResponse(req, 200, nil, "hello")
+	failing := func(w io.Writer) (io.WriteCloser, error) { return nil, errors.New("no transform") }
+	if err := TransformBody(res, upperTransform, failing); err == nil {
+		t.Errorf("Expected error")
+	}
+	if res.ContentLength != 5 {
+		t.Errorf("Response was modified: %v", res.ContentLength)
+	}
+}
+
+func TestBodyTransformFilter(t *testing.T) {
+	f := NewBodyTransformFilter(func(req *falcore.Request, res *http.Response) bool {
+		return res.Header.Get("Content-Type") == "text/plain"
+	}, upperTransform)
+
+	tests := []struct {
+		ctype  string
+		status byte
+		body   string
+	}{
+		{"text/plain", 0, "HELLO"},
+		{"image/png", 1, "hello"},
+	}
+	for _, test := range tests {
+		p := falcore.NewPipeline()
+		p.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+			return falcore.StringResponse(req.HttpRequest, 200, http.Header{"Content-Type": {test.ctype}}, "hello")
+		}))
+		p.Downstream.PushBack(f)
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		req, res := falcore.TestWithRequest(r, p, nil)
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != test.body {
+			t.Errorf("%v: expected %q got %q", test.ctype, test.body, body)
+		}
+		for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+			pss := e.Value.(*falcore.PipelineStageStat)
+			if pss.Name == "*filter.BodyTransformFilter" && pss.Status != test.status {
+				t.Errorf("%v: expected status %v got %v", test.ctype, test.status, pss.Status)
+			}
+		}
+	}
+}
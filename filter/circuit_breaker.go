@@ -0,0 +1,293 @@
+package filter
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// Returned, as the cause of a 503 *falcore.HTTPError, for requests
+// rejected by an open CircuitBreaker without a Fallback.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type CircuitState int
+
+const (
+	// Requests go through
+	CircuitClosed CircuitState = iota
+	// Requests get the Fallback
+	CircuitOpen
+	// A few trial requests go through to see if it's safe to close
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Fails fast when Filter, usually an Upstream or UpstreamPool, is in
+// trouble instead of making every request wait for it to time out.
+//
+// The breaker starts closed.  It opens after ConsecutiveFailures failures
+// in a row, or a failure rate of at least FailureRate over Window once
+// there have been MinRequests requests in it.  While it's open requests
+// get Fallback, or a 503 if there isn't one, and the stage Status is 1
+// (Skip).  After OpenTimeout it's half-open and lets HalfOpenRequests
+// requests through.  If they all succeed it closes, and if any fails it
+// opens again.
+//
+// A failure is an error or a 5xx response.  Set IsFailure to change that.
+type CircuitBreaker struct {
+	// Used in logging
+	Name     string
+	Filter   falcore.RequestFilter
+	Fallback falcore.RequestFilter
+
+	// 0 disables
+	ConsecutiveFailures int
+	// 0 disables
+	FailureRate      float64
+	Window           time.Duration
+	MinRequests      int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+	IsFailure        func(res *http.Response, err error) bool
+	// Called after every state change, outside of the breaker's lock
+	OnStateChange func(cb *CircuitBreaker, from, to CircuitState)
+
+	mutex sync.Mutex
+	state CircuitState
+	// Bumped on every state change so results from requests that started
+	// in an earlier state are ignored
+	generation  uint64
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	// Half-open trials started and passed
+	trials       int
+	trialsPassed int
+	stats        CircuitStats
+}
+
+// Counters for a CircuitBreaker
+type CircuitStats struct {
+	State     CircuitState `json:"state"`
+	Opened    uint64       `json:"opened"`
+	HalfOpens uint64       `json:"half_opens"`
+	Closed    uint64       `json:"closed"`
+	// Requests that got the Fallback
+	Rejected uint64 `json:"rejected"`
+}
+
+// Opens after 5 failures in a row or a 50% failure rate over 10s with at
+// least 20 requests.  Stays open for 30s and closes after 3 successful
+// trials.
+func NewCircuitBreaker(name string, f falcore.RequestFilter, fallback falcore.RequestFilter) *CircuitBreaker {
+	return &CircuitBreaker{
+		Name:                name,
+		Filter:              f,
+		Fallback:            fallback,
+		ConsecutiveFailures: 5,
+		FailureRate:         0.5,
+		Window:              10 * time.Second,
+		MinRequests:         20,
+		OpenTimeout:         30 * time.Second,
+		HalfOpenRequests:    3,
+	}
+}
+
+func (cb *CircuitBreaker) FilterRequest(req *falcore.Request) *http.Response {
+	res, err := cb.FilterRequestE(req)
+	if err != nil {
+		falcore.Error("%s [%s] CircuitBreaker error: %v", req.ID, cb.Name, err)
+		return falcore.RenderError(req, err)
+	}
+	return res
+}
+
+// Implements falcore.RequestFilterE
+func (cb *CircuitBreaker) FilterRequestE(req *falcore.Request) (res *http.Response, err error) {
+	gen, ok := cb.allow()
+	if !ok {
+		req.CurrentStage.Status = 1 // Skip
+		if cb.Fallback == nil {
+			return nil, falcore.NewHTTPError(503, "", ErrCircuitOpen)
+		}
+		if fe, ok := cb.Fallback.(falcore.RequestFilterE); ok {
+			return fe.FilterRequestE(req)
+		}
+		return cb.Fallback.FilterRequest(req), nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			cb.record(gen, true)
+			panic(r)
+		}
+	}()
+	if fe, ok := cb.Filter.(falcore.RequestFilterE); ok {
+		res, err = fe.FilterRequestE(req)
+	} else {
+		res = cb.Filter.FilterRequest(req)
+	}
+	cb.record(gen, cb.isFailure(res, err))
+	return
+}
+
+// Implements falcore.PipelineBrancher
+func (cb *CircuitBreaker) PipelineBranches() []falcore.PipelineBranch {
+	branches := []falcore.PipelineBranch{{Label: "closed", Filter: cb.Filter}}
+	if cb.Fallback != nil {
+		branches = append(branches, falcore.PipelineBranch{Label: "open", Filter: cb.Fallback})
+	}
+	return branches
+}
+
+func (cb *CircuitBreaker) State() CircuitState {
+	return cb.Stats().State
+}
+
+func (cb *CircuitBreaker) Stats() CircuitStats {
+	cb.mutex.Lock()
+	from, to := cb.checkTimeout(time.Now())
+	stats := cb.stats
+	stats.State = cb.state
+	cb.mutex.Unlock()
+	cb.notify(from, to)
+	return stats
+}
+
+func (cb *CircuitBreaker) isFailure(res *http.Response, err error) bool {
+	if cb.IsFailure != nil {
+		return cb.IsFailure(res, err)
+	}
+	return err != nil || (res != nil && res.StatusCode >= 500)
+}
+
+// At least one trial is needed to close
+func (cb *CircuitBreaker) halfOpenRequests() int {
+	if cb.HalfOpenRequests < 1 {
+		return 1
+	}
+	return cb.HalfOpenRequests
+}
+
+// Whether a request may go through, and the generation to record its
+// result against
+func (cb *CircuitBreaker) allow() (uint64, bool) {
+	cb.mutex.Lock()
+	from, to := cb.checkTimeout(time.Now())
+	gen := cb.generation
+	ok := true
+	switch cb.state {
+	case CircuitOpen:
+		ok = false
+	case CircuitHalfOpen:
+		if cb.trials >= cb.halfOpenRequests() {
+			ok = false
+		} else {
+			cb.trials++
+		}
+	}
+	if !ok {
+		cb.stats.Rejected++
+	}
+	cb.mutex.Unlock()
+	cb.notify(from, to)
+	return gen, ok
+}
+
+func (cb *CircuitBreaker) record(gen uint64, failed bool) {
+	now := time.Now()
+	cb.mutex.Lock()
+	from := cb.state
+	if gen == cb.generation {
+		switch cb.state {
+		case CircuitHalfOpen:
+			if failed {
+				cb.setState(CircuitOpen, now)
+			} else if cb.trialsPassed++; cb.trialsPassed >= cb.halfOpenRequests() {
+				cb.setState(CircuitClosed, now)
+			}
+		case CircuitClosed:
+			if cb.Window > 0 && now.Sub(cb.windowStart) >= cb.Window {
+				cb.windowStart = now
+				cb.requests = 0
+				cb.failures = 0
+			}
+			cb.requests++
+			if failed {
+				cb.consecutive++
+				cb.failures++
+			} else {
+				cb.consecutive = 0
+			}
+			if (cb.ConsecutiveFailures > 0 && cb.consecutive >= cb.ConsecutiveFailures) ||
+				(cb.FailureRate > 0 && cb.requests >= cb.MinRequests &&
+					float64(cb.failures) >= cb.FailureRate*float64(cb.requests)) {
+				cb.setState(CircuitOpen, now)
+			}
+		}
+	}
+	to := cb.state
+	cb.mutex.Unlock()
+	cb.notify(from, to)
+}
+
+// Moves from open to half-open once OpenTimeout has passed.  Returns the
+// states before and after.  Must be called with mutex held.
+func (cb *CircuitBreaker) checkTimeout(now time.Time) (from, to CircuitState) {
+	from = cb.state
+	if cb.state == CircuitOpen && !now.Before(cb.openUntil) {
+		cb.setState(CircuitHalfOpen, now)
+	}
+	return from, cb.state
+}
+
+// Must be called with mutex held
+func (cb *CircuitBreaker) setState(state CircuitState, now time.Time) {
+	cb.state = state
+	cb.generation++
+	cb.consecutive = 0
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+	cb.trials = 0
+	cb.trialsPassed = 0
+	switch state {
+	case CircuitOpen:
+		cb.openUntil = now.Add(cb.OpenTimeout)
+		cb.stats.Opened++
+	case CircuitHalfOpen:
+		cb.stats.HalfOpens++
+	case CircuitClosed:
+		cb.stats.Closed++
+	}
+}
+
+func (cb *CircuitBreaker) notify(from, to CircuitState) {
+	if from == to {
+		return
+	}
+	falcore.Warn("[%s] Circuit breaker %v -> %v", cb.Name, from, to)
+	if cb.OnStateChange != nil {
+		cb.OnStateChange(cb, from, to)
+	}
+}
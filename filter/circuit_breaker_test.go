@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// A filter that fails while *failing is true
+func flakyFilter(failing *bool) falcore.RequestFilterE {
+	return falcore.NewRequestFilterE(func(req *falcore.Request) (*http.Response, error) {
+		if *failing {
+			req.CurrentStage.Status = 2
+			return nil, falcore.NewHTTPError(502, "", errors.New("backend down"))
+		}
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "ok"), nil
+	})
+}
+
+func readBody(res *http.Response) string {
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return string(body)
+}
+
+func breakerRequest(cb *CircuitBreaker) (*falcore.Request, *http.Response) {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	return falcore.TestWithRequest(tmp, cb, nil)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	failing := true
+	fallback := falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "cached")
+	})
+	cb := NewCircuitBreaker("test", flakyFilter(&failing).(falcore.RequestFilter), fallback)
+	cb.ConsecutiveFailures = 3
+	cb.OpenTimeout = 50 * time.Millisecond
+	cb.HalfOpenRequests = 2
+	var transitions []string
+	cb.OnStateChange = func(cb *CircuitBreaker, from, to CircuitState) {
+		transitions = append(transitions, from.String()+">"+to.String())
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, res := breakerRequest(cb); res.StatusCode != 502 {
+			t.Fatalf("Expected the failure to pass through, got %v", res.StatusCode)
+		}
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("Expected open, got %v", cb.State())
+	}
+
+	// Fails fast with the fallback
+	failing = false
+	req, res := breakerRequest(cb)
+	if body := readBody(res); body != "cached" {
+		t.Errorf("Expected the fallback, got %v", body)
+	}
+	if req.CurrentStage.Status != 1 {
+		t.Errorf("Expected Skip status, got %v", req.CurrentStage.Status)
+	}
+
+	// A failed trial opens it again
+	time.Sleep(60 * time.Millisecond)
+	failing = true
+	if _, res := breakerRequest(cb); res.StatusCode != 502 {
+		t.Errorf("Expected a trial, got %v", res.StatusCode)
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("Expected open after a failed trial, got %v", cb.State())
+	}
+
+	// Two good trials close it
+	time.Sleep(60 * time.Millisecond)
+	failing = false
+	for i := 0; i < 2; i++ {
+		if _, res := breakerRequest(cb); readBody(res) != "ok" {
+			t.Fatalf("Expected trial %v to go through", i)
+		}
+	}
+	if cb.State() != CircuitClosed {
+		t.Fatalf("Expected closed, got %v", cb.State())
+	}
+
+	expected := "[closed>open open>half-open half-open>open open>half-open half-open>closed]"
+	if s := fmt.Sprint(transitions); s != expected {
+		t.Errorf("Expected transitions %v, got %v", expected, s)
+	}
+	stats := cb.Stats()
+	if stats.Opened != 2 || stats.HalfOpens != 2 || stats.Closed != 1 || stats.Rejected != 1 {
+		t.Errorf("Bad stats %+v", stats)
+	}
+}
+
+func TestCircuitBreakerHalfOpenLimit(t *testing.T) {
+	failing := false
+	cb := NewCircuitBreaker("test", flakyFilter(&failing).(falcore.RequestFilter), nil)
+	cb.ConsecutiveFailures = 0
+	cb.FailureRate = 0.5
+	cb.MinRequests = 4
+	cb.HalfOpenRequests = 1
+	cb.OpenTimeout = time.Hour
+
+	for _, fail := range []bool{false, true, false, true} {
+		failing = fail
+		breakerRequest(cb)
+	}
+	if cb.State() != CircuitOpen {
+		t.Fatalf("Expected open at 50%%, got %v", cb.State())
+	}
+	_, res := breakerRequest(cb)
+	if res.StatusCode != 503 {
+		t.Errorf("Expected 503 without a fallback, got %v", res.StatusCode)
+	}
+
+	// Only one trial at a time
+	cb.mutex.Lock()
+	cb.openUntil = time.Now()
+	cb.mutex.Unlock()
+	gen, ok := cb.allow()
+	if _, ok2 := cb.allow(); !ok || ok2 {
+		t.Errorf("Expected exactly one trial: %v %v", ok, ok2)
+	}
+	cb.record(gen, false)
+	if cb.State() != CircuitClosed {
+		t.Errorf("Expected closed, got %v", cb.State())
+	}
+}
@@ -66,38 +66,27 @@ func (c *CompressionFilter) FilterResponse(request *falcore.Request, res *http.R
 			}
 		}
 
-		var compressor io.WriteCloser
-		pReader, pWriter := io.Pipe()
+		var transform BodyTransform
 		switch mode {
 		case "gzip":
-			compressor = gzip.NewWriter(pWriter)
+			transform = func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriter(w), nil
+			}
 		case "deflate":
-			comp, err := flate.NewWriter(pWriter, -1)
-			if err != nil {
-				falcore.Error("Compression Error: %v", err)
-				request.CurrentStage.Status = 1 // Skip
-				return
+			transform = func(w io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(w, -1)
 			}
-			compressor = comp
 		default:
 			request.CurrentStage.Status = 1 // Skip
 			return
 		}
 
-		// Perform compression
-		var rdr = res.Body
-		go func() {
-			_, err := io.Copy(compressor, rdr)
-			compressor.Close()
-			pWriter.Close()
-			rdr.Close()
-			if err != nil {
-				falcore.Error("Error compressing body: %v", err)
-			}
-		}()
-
-		res.ContentLength = -1
-		res.Body = pReader
+		// Compress as the body is written
+		if err := TransformBody(res, transform); err != nil {
+			falcore.Error("Compression Error: %v", err)
+			request.CurrentStage.Status = 1 // Skip
+			return
+		}
 		res.Header.Set("Content-Encoding", mode)
 	} else {
 		request.CurrentStage.Status = 1 // Skip
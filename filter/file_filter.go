@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"errors"
 	"github.com/fitstar/falcore"
 	"mime"
 	"net/http"
@@ -21,7 +22,18 @@ type FileFilter struct {
 	DirectoryIndex string
 }
 
-func (f *FileFilter) FilterRequest(req *falcore.Request) (res *http.Response) {
+func (f *FileFilter) FilterRequest(req *falcore.Request) *http.Response {
+	res, err := f.FilterRequestE(req)
+	if err != nil {
+		falcore.Error("%s FileFilter error: %v", req.ID, err)
+		return falcore.RenderError(req, err)
+	}
+	return res
+}
+
+// Implements falcore.RequestFilterE.  A missing BasePath is a 500
+// *falcore.HTTPError.
+func (f *FileFilter) FilterRequestE(req *falcore.Request) (res *http.Response, _ error) {
 	// Clean asset path
 	asset_path := filepath.Clean(filepath.FromSlash(req.HttpRequest.URL.Path))
 
@@ -37,8 +49,7 @@ func (f *FileFilter) FilterRequest(req *falcore.Request) (res *http.Response) {
 	if f.BasePath != "" {
 		asset_path = filepath.Join(f.BasePath, asset_path)
 	} else {
-		falcore.Error("file_filter requires a BasePath")
-		return falcore.StringResponse(req.HttpRequest, 500, nil, "Server Error\n")
+		return nil, falcore.NewHTTPError(500, "", errors.New("file_filter requires a BasePath"))
 	}
 
 	// Open File
@@ -49,7 +60,7 @@ func (f *FileFilter) FilterRequest(req *falcore.Request) (res *http.Response) {
 
 			asset_path = filepath.Join(asset_path, f.DirectoryIndex)
 			if file, err = os.Open(asset_path); err != nil {
-				return
+				return nil, nil
 			}
 		}
 
@@ -1,11 +1,16 @@
 package filter
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/falcoretest"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandlerFilter(t *testing.T) {
@@ -30,3 +35,107 @@ func TestHandlerFilter(t *testing.T) {
 	}
 
 }
+
+// Start a server with h as its only filter.  Returns it and its address.
+// It's stopped when the test finishes.
+func startHandlerServer(t *testing.T, h http.Handler) (*falcoretest.Server, string) {
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(NewHandlerFilter(h))
+	srv := falcoretest.NewServer(t, pipeline)
+	return srv, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestHandlerFilterKeepAlive(t *testing.T) {
+	_, addr := startHandlerServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Request %v: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.ContentLength != 5 || len(res.TransferEncoding) != 0 || res.Close || string(body) != "hello" {
+			t.Errorf("Request %v: bad response %v %v %v %q", i, res.ContentLength, res.TransferEncoding, res.Close, body)
+		}
+		if res.ProtoMinor != 1 {
+			t.Errorf("Expected HTTP/1.1, got %v", res.Proto)
+		}
+	}
+}
+
+func TestHandlerFilterFlush(t *testing.T) {
+	proceed := make(chan bool)
+	srv, _ := startHandlerServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-proceed
+		w.Write([]byte("second\n"))
+	}))
+
+	res, err := srv.Client.Get("/")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer res.Body.Close()
+	line := make(chan string, 1)
+	br := bufio.NewReader(res.Body)
+	go func() {
+		l, _ := br.ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		if l != "first\n" {
+			t.Errorf("Bad first line %q", l)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Flush didn't reach the client")
+	}
+	close(proceed)
+	if rest, _ := ioutil.ReadAll(br); string(rest) != "second\n" {
+		t.Errorf("Bad rest of body %q", rest)
+	}
+}
+
+func TestHandlerFilterHijack(t *testing.T) {
+	_, addr := startHandlerServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		l, _ := brw.ReadString('\n')
+		brw.WriteString("echo: " + l)
+		brw.Flush()
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != 101 {
+		t.Fatalf("Bad upgrade: %v %v", res, err)
+	}
+	fmt.Fprintf(conn, "ping\n")
+	if l, _ := br.ReadString('\n'); l != "echo: ping\n" {
+		t.Errorf("Bad echo %q", l)
+	}
+}
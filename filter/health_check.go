@@ -0,0 +1,321 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// Active health checking for the servers in an UpstreamPool.  Every
+// Interval each server gets a request, or just a TCP connection if TCPOnly
+// is set.  A server that fails Fall checks in a row is marked down and one
+// that passes Rise checks in a row is marked up again.
+//
+// An HTTP check passes if the status is in one of the Expect ranges and,
+// if ExpectBody is set, the first 64KB of the body contain it.
+type HealthCheck struct {
+	Interval time.Duration
+	// For the whole check, including reading the body
+	Timeout time.Duration
+	Rise    int
+	Fall    int
+
+	TCPOnly bool
+	Method  string
+	Path    string
+	// The Host header.  Defaults to localhost.
+	Host       string
+	Expect     []StatusRange
+	ExpectBody string
+}
+
+// An inclusive range of status codes
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// Parses "200", "200-299" or "2xx"
+func ParseStatusRange(s string) (StatusRange, error) {
+	if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+		min := int(s[0]-'0') * 100
+		return StatusRange{min, min + 99}, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	min, err1 := strconv.Atoi(lo)
+	max, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || min < 100 || max > 599 || min > max {
+		return StatusRange{}, fmt.Errorf("bad status range %q", s)
+	}
+	return StatusRange{min, max}, nil
+}
+
+// Checks GET path every 3s with a 2s timeout.  Any 2xx passes.  Servers go
+// down after 3 failures and come back after 2 successes.
+func NewHealthCheck(path string) *HealthCheck {
+	return &HealthCheck{
+		Interval: 3 * time.Second,
+		Timeout:  2 * time.Second,
+		Rise:     2,
+		Fall:     3,
+		Method:   "GET",
+		Path:     path,
+		Expect:   []StatusRange{{200, 299}},
+	}
+}
+
+// How Upstream.PingPath has always been checked: only 200 passes and a
+// single result changes the state.
+func pingPathCheck(path string) *HealthCheck {
+	hc := NewHealthCheck(path)
+	hc.Rise = 1
+	hc.Fall = 1
+	hc.Expect = []StatusRange{{200, 200}}
+	return hc
+}
+
+var errUnexpectedBody = errors.New("body didn't match")
+
+// Runs the check against u.  nil means it passed.
+func (hc *HealthCheck) run(u *Upstream) error {
+	ctx := context.Background()
+	if hc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, hc.Timeout)
+		defer cancel()
+	}
+	if hc.TCPOnly {
+		c, err := u.Transport.dial(ctx, "tcp", "")
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	method := hc.Method
+	if method == "" {
+		method = "GET"
+	}
+	host := hc.Host
+	if host == "" {
+		host = "localhost"
+	}
+	// The host in the URL is ignored by the dialer, which always
+	// connects to the upstream
+	req, err := http.NewRequestWithContext(ctx, method, u.Transport.scheme()+"://"+host+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Keep-Alive")
+	res, err := u.Transport.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if !hc.statusOK(res.StatusCode) {
+		return fmt.Errorf("unexpected status %v", res.Status)
+	}
+	if hc.ExpectBody != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), hc.ExpectBody) {
+			return errUnexpectedBody
+		}
+	} else {
+		// So the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	}
+	return nil
+}
+
+func (hc *HealthCheck) statusOK(status int) bool {
+	if len(hc.Expect) == 0 {
+		return status >= 200 && status <= 299
+	}
+	for _, r := range hc.Expect {
+		if status >= r.Min && status <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// Active health check state for an UpstreamEntry.  Guarded by the pool's
+// weightMutex.
+type checkState struct {
+	running   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastErr   error
+}
+
+// The pool's HealthCheck.  Shared by every copy of the pool.
+type poolChecks struct {
+	mutex   sync.Mutex
+	check   *HealthCheck
+	changed chan struct{}
+}
+
+// Replace the pool's health check.  nil goes back to checking the PingPath
+// of each Upstream that has one.  Takes effect immediately.
+func (up UpstreamPool) SetHealthCheck(hc *HealthCheck) {
+	up.checks.mutex.Lock()
+	up.checks.check = hc
+	up.checks.mutex.Unlock()
+	select {
+	case up.checks.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the pool's health check, or nil if it uses PingPaths
+func (up UpstreamPool) HealthCheck() *HealthCheck {
+	up.checks.mutex.Lock()
+	defer up.checks.mutex.Unlock()
+	return up.checks.check
+}
+
+// The check to run on ue, or nil if it isn't checked
+func (up UpstreamPool) checkFor(ue *UpstreamEntry, poolCheck *HealthCheck) *HealthCheck {
+	if poolCheck != nil {
+		return poolCheck
+	}
+	if ue.Upstream.PingPath != "" {
+		return pingPathCheck(ue.Upstream.PingPath)
+	}
+	return nil
+}
+
+func (up UpstreamPool) pingUpstreams() {
+	for {
+		interval := 3 * time.Second
+		hc := up.HealthCheck()
+		if hc != nil && hc.Interval > 0 {
+			interval = hc.Interval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-up.shutdown:
+			timer.Stop()
+			return
+		case <-up.checks.changed:
+			timer.Stop()
+		case <-timer.C:
+			for _, ue := range up.Entries() {
+				if check := up.checkFor(ue, hc); check != nil {
+					up.pingUpstream(ue, check)
+				}
+			}
+		}
+	}
+}
+
+// Starts a check of ue unless the last one is still running
+func (up UpstreamPool) pingUpstream(ue *UpstreamEntry, hc *HealthCheck) {
+	up.weightMutex.Lock()
+	if ue.check.running {
+		up.weightMutex.Unlock()
+		return
+	}
+	ue.check.running = true
+	up.weightMutex.Unlock()
+
+	go func() {
+		err := hc.run(ue.Upstream)
+		if up.recordCheck(ue, hc, err) {
+			if err != nil {
+				falcore.Error("[%s] Failed health check of %v:%v: %v", up.Name, ue.Upstream.Transport.host, ue.Upstream.Transport.port, err)
+			}
+			up.LogStatus()
+		}
+	}()
+}
+
+// Returns true if ue went up or down
+func (up UpstreamPool) recordCheck(ue *UpstreamEntry, hc *HealthCheck, err error) bool {
+	up.weightMutex.Lock()
+	defer up.weightMutex.Unlock()
+	s := &ue.check
+	s.running = false
+	s.lastCheck = time.Now()
+	s.lastErr = err
+	if err == nil {
+		s.successes++
+		s.failures = 0
+		if ue.down && s.successes >= hc.Rise {
+			ue.down = false
+			return true
+		}
+	} else {
+		s.failures++
+		s.successes = 0
+		if !ue.down && s.failures >= hc.Fall {
+			ue.down = true
+			return true
+		}
+	}
+	return false
+}
+
+// A snapshot of a server's health for status pages and admin APIs
+type UpstreamHealth struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Weight int    `json:"weight"`
+	// Whether it's getting traffic.  False if it's down or ejected.
+	Healthy bool `json:"healthy"`
+	// Finishing its requests before it's removed.  See UpstreamPool.Drain.
+	Draining bool `json:"draining"`
+	// Marked down by the active health check
+	Down           bool      `json:"down"`
+	LastCheck      time.Time `json:"last_check"`
+	LastCheckError string    `json:"last_check_error,omitempty"`
+	// Ejected by outlier detection
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejected_until"`
+	InFlight     int64     `json:"in_flight"`
+}
+
+// The health of each server in the pool, in order
+func (up UpstreamPool) Health() []UpstreamHealth {
+	up.weightMutex.RLock()
+	entries := *up.pool
+	health := make([]UpstreamHealth, len(entries))
+	for i, ue := range entries {
+		h := &health[i]
+		h.Name = ue.Upstream.Name
+		h.Host = ue.Upstream.Transport.host
+		h.Port = ue.Upstream.Transport.port
+		h.Weight = ue.Weight
+		h.Healthy = ue.healthy() && !ue.draining
+		h.Draining = ue.draining
+		h.Down = ue.down
+		h.LastCheck = ue.check.lastCheck
+		if ue.check.lastErr != nil {
+			h.LastCheckError = ue.check.lastErr.Error()
+		}
+		h.Ejected = !ue.health.ejectedUntil.IsZero()
+		h.EjectedUntil = ue.health.ejectedUntil
+	}
+	up.weightMutex.RUnlock()
+	for i, ue := range entries {
+		health[i].InFlight = ue.Upstream.InFlight()
+	}
+	return health
+}
@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/falcoretest"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	for _, test := range []struct {
+		in       string
+		min, max int
+		ok       bool
+	}{
+		{"200", 200, 200, true},
+		{"200-399", 200, 399, true},
+		{"3xx", 300, 399, true},
+		{"6xx", 0, 0, false},
+		{"300-200", 0, 0, false},
+		{"abc", 0, 0, false},
+	} {
+		r, err := ParseStatusRange(test.in)
+		if (err == nil) != test.ok || r.Min != test.min || r.Max != test.max {
+			t.Errorf("%v: got %v %v", test.in, r, err)
+		}
+	}
+}
+
+// Polls cond until it's true or a couple of seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %v", what)
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	var status int32 = 200
+	var host atomic.Value
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		host.Store(req.HttpRequest.Host)
+		if req.HttpRequest.URL.Path != "/health" {
+			return falcore.StringResponse(req.HttpRequest, 404, nil, "")
+		}
+		return falcore.StringResponse(req.HttpRequest, int(atomic.LoadInt32(&status)), nil, "status: ok")
+	}))
+	pool := retryPool(t, nil, falcoretest.NewServer(t, p).Server.Port())
+	ue := pool.Entries()[0]
+
+	hc := NewHealthCheck("/health")
+	hc.Interval = 10 * time.Millisecond
+	hc.Host = "app.internal"
+	hc.Expect = []StatusRange{{200, 299}, {429, 429}}
+	hc.ExpectBody = "ok"
+	pool.SetHealthCheck(hc)
+
+	waitFor(t, "a check", func() bool { return !pool.Health()[0].LastCheck.IsZero() })
+	if h, _ := host.Load().(string); h != "app.internal" {
+		t.Errorf("Expected the Host header to be set, got %v", h)
+	}
+
+	atomic.StoreInt32(&status, 429)
+	time.Sleep(50 * time.Millisecond)
+	if !pool.IsUp(ue) {
+		t.Fatalf("429 is expected")
+	}
+
+	atomic.StoreInt32(&status, 500)
+	waitFor(t, "down", func() bool { return !pool.IsUp(ue) })
+	if h := pool.Health()[0]; h.Healthy || !h.Down || h.LastCheckError == "" {
+		t.Errorf("Bad health %+v", h)
+	}
+
+	atomic.StoreInt32(&status, 200)
+	waitFor(t, "up", func() bool { return pool.IsUp(ue) })
+
+	// Body mismatch
+	hc2 := *hc
+	hc2.ExpectBody = "great"
+	pool.SetHealthCheck(&hc2)
+	waitFor(t, "body mismatch", func() bool { return !pool.IsUp(ue) })
+}
+
+func TestHealthCheckTCPAndTimeout(t *testing.T) {
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		time.Sleep(100 * time.Millisecond)
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "slow")
+	}))
+	slow := falcoretest.NewServer(t, p).Server.Port()
+	pool := retryPool(t, nil, slow, deadPort(t))
+
+	hc := NewHealthCheck("/")
+	hc.Interval = 10 * time.Millisecond
+	hc.Timeout = 20 * time.Millisecond
+	hc.Fall = 1
+	pool.SetHealthCheck(hc)
+	waitFor(t, "timeout", func() bool { return !pool.IsUp(pool.Entries()[0]) && !pool.IsUp(pool.Entries()[1]) })
+
+	// Connecting is enough
+	tcp := *hc
+	tcp.TCPOnly = true
+	tcp.Rise = 1
+	pool.SetHealthCheck(&tcp)
+	waitFor(t, "tcp", func() bool { return pool.IsUp(pool.Entries()[0]) })
+	time.Sleep(30 * time.Millisecond)
+	if pool.IsUp(pool.Entries()[1]) {
+		t.Errorf("Nothing is listening on b")
+	}
+}
@@ -0,0 +1,204 @@
+package filter
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// Passive health checking for an UpstreamPool.  A server is ejected, or
+// marked down, when its responses show it's in trouble:
+//
+//   - ConsecutiveFailures failures in a row, or
+//   - an error rate of at least ErrorRate over Window, once there have
+//     been MinRequests requests in it.
+//
+// Failures are errors from the Upstream, such as connection failures and
+// timeouts, and 5xx responses.
+//
+// An ejection lasts BaseEjection.  Then the next request is sent to the
+// server as a trial while the others keep avoiding it.  If the trial
+// succeeds the server is restored.  If not it's ejected again for twice
+// as long, up to MaxEjection.
+//
+// No more than MaxEjectionPercent of the enabled servers are ejected at
+// once, so a problem shared by every server doesn't empty the pool.
+type OutlierDetection struct {
+	// 0 disables
+	ConsecutiveFailures int
+	// 0 disables
+	ErrorRate   float64
+	Window      time.Duration
+	MinRequests int
+
+	BaseEjection       time.Duration
+	MaxEjection        time.Duration
+	MaxEjectionPercent int
+}
+
+// Ejects after 5 failures in a row or a 50% error rate over 10s with at
+// least 20 requests.  Ejections start at 10s and go up to 5m, for at most
+// half of the servers.
+func NewOutlierDetection() *OutlierDetection {
+	return &OutlierDetection{
+		ConsecutiveFailures: 5,
+		ErrorRate:           0.5,
+		Window:              10 * time.Second,
+		MinRequests:         20,
+		BaseEjection:        10 * time.Second,
+		MaxEjection:         5 * time.Minute,
+		MaxEjectionPercent:  50,
+	}
+}
+
+// Passive health state for an UpstreamEntry.  Guarded by the pool's
+// weightMutex.
+type entryHealth struct {
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	// Ejections in a row without a successful trial
+	ejections int
+	// Zero unless ejected by outlier detection
+	ejectedUntil time.Time
+	// A trial request is in flight
+	trial bool
+}
+
+// Returns an ejected server that's due for a trial, claiming the trial.
+// nil if there isn't one.
+func (up UpstreamPool) trialServer(tried map[*UpstreamEntry]bool) *UpstreamEntry {
+	if up.Outlier == nil {
+		return nil
+	}
+	now := time.Now()
+	due := func(ue *UpstreamEntry) bool {
+		h := &ue.health
+		return ue.enabled() && !ue.down && !h.trial && !h.ejectedUntil.IsZero() &&
+			!now.Before(h.ejectedUntil) && !tried[ue]
+	}
+	// Most of the time there's nothing due so avoid the write lock
+	up.weightMutex.RLock()
+	found := false
+	for _, ue := range *up.pool {
+		if due(ue) {
+			found = true
+			break
+		}
+	}
+	up.weightMutex.RUnlock()
+	if !found {
+		return nil
+	}
+
+	up.weightMutex.Lock()
+	defer up.weightMutex.Unlock()
+	for _, ue := range *up.pool {
+		if due(ue) {
+			ue.health.trial = true
+			return ue
+		}
+	}
+	return nil
+}
+
+// Recorded for a trial request that never finished, such as one that
+// panicked
+var errTrialAborted = errors.New("trial request didn't finish")
+
+// Updates ue's health with the result of a request
+func (up UpstreamPool) recordResult(req *falcore.Request, ue *UpstreamEntry, trial bool, res *http.Response, err error) {
+	od := up.Outlier
+	if od == nil {
+		return
+	}
+	failed := err != nil || (res != nil && res.StatusCode >= 500)
+	now := time.Now()
+
+	up.weightMutex.Lock()
+	h := &ue.health
+	var changed bool
+	var reason string
+	switch {
+	case trial:
+		h.trial = false
+		if failed {
+			changed = up.eject(ue, now)
+			reason = "failed trial"
+		} else {
+			up.restore(ue)
+			changed = true
+			reason = "passed trial"
+		}
+	case !ue.healthy():
+		// Already out.  Possibly a request picked before the ejection.
+	default:
+		if od.Window > 0 && now.Sub(h.windowStart) >= od.Window {
+			h.windowStart = now
+			h.requests = 0
+			h.failures = 0
+		}
+		h.requests++
+		if failed {
+			h.consecutive++
+			h.failures++
+		} else {
+			h.consecutive = 0
+		}
+		if od.ConsecutiveFailures > 0 && h.consecutive >= od.ConsecutiveFailures {
+			reason = "consecutive failures"
+		} else if od.ErrorRate > 0 && h.requests >= od.MinRequests &&
+			float64(h.failures) >= od.ErrorRate*float64(h.requests) {
+			reason = "error rate"
+		}
+		if reason != "" {
+			changed = up.eject(ue, now)
+		}
+	}
+	up.weightMutex.Unlock()
+
+	if changed {
+		falcore.Warn("%s [%s] %v:%v %v", req.ID, up.Name, ue.Upstream.Transport.host, ue.Upstream.Transport.port, reason)
+		up.LogStatus()
+	}
+}
+
+// Marks ue down for the next ejection period.  Returns false if too many
+// servers are already ejected.  Must be called with weightMutex held.
+func (up UpstreamPool) eject(ue *UpstreamEntry, now time.Time) bool {
+	od := up.Outlier
+	if ue.healthy() {
+		enabled, down := 0, 0
+		for _, e := range *up.pool {
+			if e.enabled() {
+				enabled++
+				if !e.healthy() {
+					down++
+				}
+			}
+		}
+		if (down+1)*100 > enabled*od.MaxEjectionPercent {
+			return false
+		}
+	}
+	h := &ue.health
+	d := od.BaseEjection << uint(h.ejections)
+	if d > od.MaxEjection || d <= 0 {
+		d = od.MaxEjection
+	} else {
+		h.ejections++
+	}
+	h.ejectedUntil = now.Add(d)
+	h.consecutive = 0
+	h.requests = 0
+	h.failures = 0
+	return true
+}
+
+// Must be called with weightMutex held
+func (up UpstreamPool) restore(ue *UpstreamEntry) {
+	ue.health = entryHealth{windowStart: time.Now()}
+}
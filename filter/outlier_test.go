@@ -0,0 +1,141 @@
+package filter
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+func outlierPool(od *OutlierDetection) (*UpstreamPool, []*UpstreamEntry) {
+	pool, entries := testPool(1, 1, 1)
+	pool.Outlier = od
+	return pool, entries
+}
+
+var errTestUpstream = errors.New("upstream failed")
+
+func TestOutlierConsecutiveFailures(t *testing.T) {
+	pool, entries := outlierPool(&OutlierDetection{ConsecutiveFailures: 3, BaseEjection: time.Minute, MaxEjection: time.Hour, MaxEjectionPercent: 50})
+	defer pool.Shutdown()
+	req := &falcore.Request{ID: "test"}
+	ok := &http.Response{StatusCode: 200}
+
+	pool.recordResult(req, entries[0], false, nil, errTestUpstream)
+	pool.recordResult(req, entries[0], false, &http.Response{StatusCode: 503}, nil)
+	pool.recordResult(req, entries[0], false, ok, nil)
+	pool.recordResult(req, entries[0], false, nil, errTestUpstream)
+	pool.recordResult(req, entries[0], false, nil, errTestUpstream)
+	if !pool.IsUp(entries[0]) {
+		t.Fatalf("A success should reset the count")
+	}
+	pool.recordResult(req, entries[0], false, &http.Response{StatusCode: 500}, nil)
+	if pool.IsUp(entries[0]) {
+		t.Fatalf("Expected a to be ejected")
+	}
+
+	// A second ejection would be over 50%
+	for i := 0; i < 3; i++ {
+		pool.recordResult(req, entries[1], false, nil, errTestUpstream)
+	}
+	if !pool.IsUp(entries[1]) {
+		t.Errorf("Ejected more than MaxEjectionPercent")
+	}
+	if ue, _ := pool.choose(req, nil); ue == entries[0] {
+		t.Errorf("Picked an ejected server")
+	}
+}
+
+func TestOutlierErrorRate(t *testing.T) {
+	pool, entries := outlierPool(&OutlierDetection{ErrorRate: 0.5, Window: time.Minute, MinRequests: 4, BaseEjection: time.Minute, MaxEjection: time.Hour, MaxEjectionPercent: 100})
+	defer pool.Shutdown()
+	req := &falcore.Request{ID: "test"}
+	ok := &http.Response{StatusCode: 200}
+
+	pool.recordResult(req, entries[0], false, nil, errTestUpstream)
+	pool.recordResult(req, entries[0], false, ok, nil)
+	pool.recordResult(req, entries[0], false, nil, errTestUpstream)
+	if !pool.IsUp(entries[0]) {
+		t.Fatalf("Ejected before MinRequests")
+	}
+	pool.recordResult(req, entries[0], false, ok, nil)
+	if pool.IsUp(entries[0]) {
+		t.Fatalf("Expected a to be ejected at 50%%")
+	}
+}
+
+func TestOutlierTrial(t *testing.T) {
+	pool, entries := outlierPool(&OutlierDetection{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: 3 * time.Minute, MaxEjectionPercent: 50})
+	defer pool.Shutdown()
+	req := &falcore.Request{ID: "test"}
+	a := entries[0]
+	pool.recordResult(req, a, false, nil, errTestUpstream)
+
+	// Not due yet
+	if _, trial := pool.choose(req, nil); trial {
+		t.Fatalf("Trial before the ejection ended")
+	}
+
+	// Only one trial at a time, and it fails
+	a.health.ejectedUntil = time.Now()
+	if ue, trial := pool.choose(req, nil); ue != a || !trial {
+		t.Fatalf("Expected a trial of a")
+	}
+	if ue, trial := pool.choose(req, nil); ue == a || trial {
+		t.Fatalf("Expected one trial at a time")
+	}
+	pool.recordResult(req, a, true, nil, errTestUpstream)
+	if d := time.Until(a.health.ejectedUntil); pool.IsUp(a) || d < 110*time.Second {
+		t.Fatalf("Expected a longer ejection, got %v", d)
+	}
+
+	// Backoff is capped
+	a.health.ejectedUntil = time.Now()
+	pool.choose(req, nil)
+	pool.recordResult(req, a, true, nil, errTestUpstream)
+	if d := time.Until(a.health.ejectedUntil); d > 3*time.Minute {
+		t.Fatalf("Ejection over MaxEjection: %v", d)
+	}
+
+	// Passes and is back in rotation
+	a.health.ejectedUntil = time.Now()
+	pool.choose(req, nil)
+	pool.recordResult(req, a, true, &http.Response{StatusCode: 200}, nil)
+	if !pool.IsUp(a) || a.health.ejections != 0 {
+		t.Fatalf("Expected a to be restored")
+	}
+}
+
+func TestOutlierTrialPanic(t *testing.T) {
+	pool, entries := outlierPool(&OutlierDetection{ConsecutiveFailures: 1, BaseEjection: time.Minute, MaxEjection: 3 * time.Minute, MaxEjectionPercent: 50})
+	defer pool.Shutdown()
+	// No HttpRequest, so the Upstream panics
+	req := &falcore.Request{ID: "test"}
+	a := entries[0]
+	pool.recordResult(req, a, false, nil, errTestUpstream)
+
+	a.health.ejectedUntil = time.Now()
+	ue, trial := pool.choose(req, nil)
+	if ue != a || !trial {
+		t.Fatalf("Expected a trial of a")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected a panic")
+			}
+		}()
+		pool.attempt(req, ue, trial)
+	}()
+
+	// Counted as a failed trial and a gets another one
+	if pool.IsUp(a) || time.Until(a.health.ejectedUntil) < 110*time.Second {
+		t.Fatalf("Expected a longer ejection")
+	}
+	a.health.ejectedUntil = time.Now()
+	if ue, trial := pool.choose(req, nil); ue != a || !trial {
+		t.Fatalf("Expected another trial of a")
+	}
+}
@@ -0,0 +1,42 @@
+package filter
+
+import (
+	"bytes"
+	"github.com/fitstar/falcore"
+	"net/http"
+)
+
+// A RequestFilter that describes the shape of a Pipeline.  Mount it on an
+// admin path to see how requests flow through a large nested Pipeline.
+// It responds with JSON, or with a Graphviz DOT graph if the query string
+// has format=dot.
+//
+// Pipeline is called for every request so it can return the live pipeline:
+//
+//	filter.NewPipelineDumpFilter(server.CurrentPipeline)
+type PipelineDumpFilter struct {
+	Pipeline func() *falcore.Pipeline
+}
+
+func NewPipelineDumpFilter(pipeline func() *falcore.Pipeline) *PipelineDumpFilter {
+	return &PipelineDumpFilter{Pipeline: pipeline}
+}
+
+func (f *PipelineDumpFilter) FilterRequest(req *falcore.Request) *http.Response {
+	node := falcore.InspectPipeline(f.Pipeline())
+	buf := new(bytes.Buffer)
+	headers := make(http.Header)
+	var err error
+	if req.HttpRequest.URL.Query().Get("format") == "dot" {
+		headers.Set("Content-Type", "text/vnd.graphviz")
+		err = node.WriteDOT(buf)
+	} else {
+		headers.Set("Content-Type", "application/json")
+		err = node.WriteJSON(buf)
+	}
+	if err != nil {
+		falcore.Error("%s Error dumping pipeline: %v", req.ID, err)
+		return falcore.StringResponse(req.HttpRequest, 500, nil, "Server Error\n")
+	}
+	return falcore.ByteResponse(req.HttpRequest, 200, headers, buf.Bytes())
+}
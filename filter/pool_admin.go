@@ -0,0 +1,206 @@
+package filter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/responder"
+)
+
+// Lets deploy tooling add, drain and reweight the servers in UpstreamPools
+// over HTTP.  Paths are relative to PathPrefix:
+//
+//	GET    /pools                          every pool's Health
+//	GET    /pools/{pool}                   one pool's Health
+//	POST   /pools/{pool}/servers           add {"host": "10.0.0.3", "port": 8080, "weight": 1}
+//	PUT    /pools/{pool}/servers/{name}    set the weight {"weight": 2}
+//	POST   /pools/{pool}/servers/{name}/drain?wait=30s
+//	DELETE /pools/{pool}/servers/{name}    remove right away
+//
+// Servers are named by Upstream.Name.  Added servers are named host:port
+// unless the request has a "name".  A drain
+// responds 202 right away, or with wait, 200 once the server is gone or
+// 202 if it's still draining when wait is up.  Requests outside PathPrefix
+// are passed on.
+type PoolAdmin struct {
+	PathPrefix string
+	Pools      map[string]*UpstreamPool
+	// If set, requests need an "Authorization: Bearer <Token>" header
+	Token string
+	// Creates the Upstream for an added server.  Defaults to an Upstream
+	// without a timeout.
+	NewUpstream func(pool string, host string, port int) *Upstream
+}
+
+func NewPoolAdmin(pathPrefix string, pools map[string]*UpstreamPool) *PoolAdmin {
+	return &PoolAdmin{PathPrefix: pathPrefix, Pools: pools}
+}
+
+// The body of a request to add a server or change its weight
+type poolAdminServer struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Weight *int   `json:"weight"`
+}
+
+func (pa *PoolAdmin) FilterRequest(req *falcore.Request) *http.Response {
+	res, err := pa.FilterRequestE(req)
+	if err != nil {
+		falcore.Error("%s PoolAdmin error: %v", req.ID, err)
+		return falcore.RenderError(req, err)
+	}
+	return res
+}
+
+// Implements falcore.RequestFilterE.  Bad requests are returned as
+// *falcore.HTTPErrors.
+func (pa *PoolAdmin) FilterRequestE(req *falcore.Request) (*http.Response, error) {
+	path := req.HttpRequest.URL.Path
+	if !strings.HasPrefix(path, pa.PathPrefix) {
+		return nil, nil
+	}
+	if pa.Token != "" {
+		auth := req.HttpRequest.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+pa.Token)) != 1 {
+			return nil, falcore.NewHTTPError(401, "", nil)
+		}
+	}
+
+	parts := strings.Split(strings.Trim(path[len(pa.PathPrefix):], "/"), "/")
+	if parts[0] != "pools" {
+		return nil, falcore.NewHTTPError(404, "", nil)
+	}
+	method := req.HttpRequest.Method
+	if len(parts) == 1 {
+		if method != "GET" {
+			return nil, falcore.NewHTTPError(405, "", nil)
+		}
+		health := make(map[string][]UpstreamHealth, len(pa.Pools))
+		for name, pool := range pa.Pools {
+			health[name] = pool.Health()
+		}
+		return responder.JSONResponse(req.HttpRequest, 200, nil, health)
+	}
+
+	pool, ok := pa.Pools[parts[1]]
+	if !ok {
+		return nil, falcore.NewHTTPError(404, fmt.Sprintf("no pool %q", parts[1]), nil)
+	}
+	switch {
+	case len(parts) == 2 && method == "GET":
+		return responder.JSONResponse(req.HttpRequest, 200, nil, pool.Health())
+	case len(parts) == 3 && parts[2] == "servers" && method == "POST":
+		return pa.add(req, parts[1], pool)
+	case len(parts) < 4 || parts[2] != "servers" || len(parts) > 5:
+		return nil, falcore.NewHTTPError(404, "", nil)
+	}
+
+	ue := findEntry(pool, parts[3])
+	if ue == nil {
+		return nil, falcore.NewHTTPError(404, fmt.Sprintf("no server %q", parts[3]), nil)
+	}
+	switch {
+	case len(parts) == 5 && parts[4] == "drain" && method == "POST":
+		return pa.drain(req, pool, ue)
+	case len(parts) == 5:
+		return nil, falcore.NewHTTPError(404, "", nil)
+	case method == "PUT":
+		var body poolAdminServer
+		if err := json.NewDecoder(req.HttpRequest.Body).Decode(&body); err != nil || body.Weight == nil {
+			return nil, falcore.NewHTTPError(400, "weight is required", err)
+		}
+		if !pool.SetWeight(ue, *body.Weight) {
+			return nil, falcore.NewHTTPError(400, "weight must not be negative", nil)
+		}
+	case method == "DELETE":
+		pool.Remove(ue)
+		ue.Upstream.Transport.transport.CloseIdleConnections()
+	default:
+		return nil, falcore.NewHTTPError(405, "", nil)
+	}
+	pool.LogStatus()
+	return responder.JSONResponse(req.HttpRequest, 200, nil, pool.Health())
+}
+
+func (pa *PoolAdmin) add(req *falcore.Request, name string, pool *UpstreamPool) (*http.Response, error) {
+	var body poolAdminServer
+	if err := json.NewDecoder(req.HttpRequest.Body).Decode(&body); err != nil {
+		return nil, falcore.NewHTTPError(400, "", err)
+	}
+	if body.Host == "" || body.Port <= 0 || body.Port > 65535 {
+		return nil, falcore.NewHTTPError(400, "host and port are required", nil)
+	}
+	weight := 1
+	if body.Weight != nil {
+		weight = *body.Weight
+	}
+	if weight < 0 {
+		return nil, falcore.NewHTTPError(400, "weight must not be negative", nil)
+	}
+
+	serverName := body.Name
+	if serverName == "" {
+		serverName = fmt.Sprintf("%v:%v", body.Host, body.Port)
+	}
+	// Saves creating an Upstream.  Add makes sure of it.
+	if findEntry(pool, serverName) != nil {
+		return nil, falcore.NewHTTPError(409, fmt.Sprintf("server %q exists", serverName), ErrServerExists)
+	}
+
+	var u *Upstream
+	if pa.NewUpstream != nil {
+		u = pa.NewUpstream(name, body.Host, body.Port)
+	} else {
+		u = NewUpstream(NewUpstreamTransport(body.Host, body.Port, 0, nil))
+	}
+	u.Name = serverName
+	if err := pool.Add(&UpstreamEntry{Upstream: u, Weight: weight}); err != nil {
+		return nil, falcore.NewHTTPError(409, fmt.Sprintf("server %q exists", serverName), err)
+	}
+	falcore.Info("%s [%s] Added %v", req.ID, pool.Name, u.Name)
+	pool.LogStatus()
+	return responder.JSONResponse(req.HttpRequest, 201, nil, pool.Health())
+}
+
+func (pa *PoolAdmin) drain(req *falcore.Request, pool *UpstreamPool, ue *UpstreamEntry) (*http.Response, error) {
+	var wait time.Duration
+	if s := req.HttpRequest.URL.Query().Get("wait"); s != "" {
+		var err error
+		if wait, err = time.ParseDuration(s); err != nil {
+			return nil, falcore.NewHTTPError(400, "bad wait", err)
+		}
+	}
+	done := pool.Drain(ue)
+	if done == nil {
+		// Removed since it was looked up
+		return nil, falcore.NewHTTPError(404, fmt.Sprintf("no server %q", ue.Upstream.Name), nil)
+	}
+	status := 202
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			status = 200
+		case <-timer.C:
+		case <-req.HttpRequest.Context().Done():
+		}
+		timer.Stop()
+	}
+	return responder.JSONResponse(req.HttpRequest, status, nil, pool.Health())
+}
+
+// The server named name, or nil
+func findEntry(pool *UpstreamPool, name string) *UpstreamEntry {
+	for _, ue := range pool.Entries() {
+		if ue.Upstream.Name == name {
+			return ue
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+func adminRequest(pa *PoolAdmin, method, path, body string) *http.Response {
+	tmp, _ := http.NewRequest(method, "http://admin"+path, strings.NewReader(body))
+	tmp.Header.Set("Authorization", "Bearer secret")
+	_, res := falcore.TestWithRequest(tmp, pa, nil)
+	return res
+}
+
+func TestPoolAdmin(t *testing.T) {
+	pool, _ := testPool(1)
+	defer pool.Shutdown()
+	pa := NewPoolAdmin("/admin", map[string]*UpstreamPool{"app": pool})
+	pa.Token = "secret"
+	var created []string
+	pa.NewUpstream = func(pool, host string, port int) *Upstream {
+		created = append(created, pool)
+		return NewUpstream(NewUpstreamTransport(host, port, 0, nil))
+	}
+
+	tmp, _ := http.NewRequest("GET", "http://admin/admin/pools", nil)
+	if _, res := falcore.TestWithRequest(tmp, pa, nil); res.StatusCode != 401 {
+		t.Errorf("Expected 401 without the token, got %v", res.StatusCode)
+	}
+	if res := adminRequest(pa, "GET", "/other", ""); res != nil {
+		t.Errorf("Expected requests outside the prefix to pass, got %v", res.StatusCode)
+	}
+
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+		servers            string
+	}{
+		{"GET", "/admin/pools/app", "", 200, "a:1"},
+		{"POST", "/admin/pools/app/servers", `{"host": "localhost", "port": 9005, "weight": 3}`, 201, "a:1 localhost:9005:3"},
+		{"POST", "/admin/pools/app/servers", `{"host": "localhost", "port": 9005}`, 409, ""},
+		{"POST", "/admin/pools/app/servers", `{"host": "localhost"}`, 400, ""},
+		{"PUT", "/admin/pools/app/servers/a", `{"weight": 2}`, 200, "a:2 localhost:9005:3"},
+		{"PUT", "/admin/pools/app/servers/a", `{}`, 400, ""},
+		{"POST", "/admin/pools/app/servers/a/drain?wait=1s", "", 200, "localhost:9005:3"},
+		{"DELETE", "/admin/pools/app/servers/localhost:9005", "", 200, ""},
+		{"DELETE", "/admin/pools/app/servers/a", "", 404, ""},
+		{"GET", "/admin/pools/nope", "", 404, ""},
+		{"PATCH", "/admin/pools/app/servers/b", "", 404, ""},
+	} {
+		res := adminRequest(pa, test.method, test.path, test.body)
+		if res.StatusCode != test.status {
+			t.Errorf("%v %v: expected %v, got %v", test.method, test.path, test.status, res.StatusCode)
+			continue
+		}
+		if test.status >= 300 {
+			continue
+		}
+		var health []UpstreamHealth
+		if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+			t.Fatalf("%v %v: bad body: %v", test.method, test.path, err)
+		}
+		var servers []string
+		for _, h := range health {
+			servers = append(servers, h.Name+":"+string(rune('0'+h.Weight)))
+		}
+		if s := strings.Join(servers, " "); s != test.servers {
+			t.Errorf("%v %v: expected %q, got %q", test.method, test.path, test.servers, s)
+		}
+	}
+	if len(created) != 1 || created[0] != "app" {
+		t.Errorf("Expected NewUpstream to be called for app, got %v", created)
+	}
+
+	res := adminRequest(pa, "GET", "/admin/pools", "")
+	var all map[string][]UpstreamHealth
+	if err := json.NewDecoder(res.Body).Decode(&all); err != nil || len(all) != 1 {
+		t.Errorf("Bad pools %v %v", all, err)
+	}
+}
+
+func TestPoolAdminConcurrent(t *testing.T) {
+	pool, entries := testPool(1)
+	defer pool.Shutdown()
+	pa := NewPoolAdmin("/admin", map[string]*UpstreamPool{"app": pool})
+
+	// Only one of the same server is added
+	statuses := make(chan int, 10)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			statuses <- adminRequest(pa, "POST", "/admin/pools/app/servers", `{"host": "localhost", "port": 9005}`).StatusCode
+		}()
+	}
+	added := 0
+	for i := 0; i < cap(statuses); i++ {
+		if <-statuses == 201 {
+			added++
+		}
+	}
+	if added != 1 || len(pool.Entries()) != 2 {
+		t.Errorf("Expected one add, got %v and %v servers", added, len(pool.Entries()))
+	}
+
+	// A server removed after it was looked up doesn't wait
+	pool.Remove(entries[0])
+	tmp, _ := http.NewRequest("POST", "http://admin/admin/pools/app/servers/a/drain?wait=10s", nil)
+	start := time.Now()
+	if _, err := pa.drain(&falcore.Request{HttpRequest: tmp}, pool, entries[0]); falcore.AsHTTPError(err).StatusCode != 404 {
+		t.Errorf("Expected a 404, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Waited %v", d)
+	}
+}
@@ -0,0 +1,183 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/fitstar/falcore"
+)
+
+// The standard reverse proxy request headers an Upstream adds.
+//
+// Forwarding headers on requests from TrustedProxies are kept and the
+// client is appended to them, so the upstream sees the whole chain.  On
+// requests from anyone else they can't be believed, so X-Forwarded-* and
+// Forwarded are removed and replaced with what this proxy saw.
+type ProxyHeaders struct {
+	// Addresses of the proxies in front of this one
+	TrustedProxies []*net.IPNet
+	// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+	XForwarded bool
+	// The RFC 7239 Forwarded header
+	Forwarded bool
+	// The pseudonym added to Via, like "falcore".  Empty doesn't add Via.
+	Via string
+}
+
+// Adds X-Forwarded-* and Via and trusts no one
+func NewProxyHeaders() *ProxyHeaders {
+	return &ProxyHeaders{
+		XForwarded: true,
+		Via:        "falcore",
+	}
+}
+
+// Parses CIDRs like "10.0.0.0/8".  A plain address is a network of one.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (ph *ProxyHeaders) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range ph.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the headers on out, the request going to the upstream
+func (ph *ProxyHeaders) apply(request *falcore.Request, out *http.Request) {
+	h := out.Header
+	ip := clientIP(request)
+	if !ph.trusted(ip) {
+		h.Del("X-Forwarded-For")
+		h.Del("X-Forwarded-Proto")
+		h.Del("X-Forwarded-Host")
+		h.Del("Forwarded")
+	}
+
+	proto := "http"
+	if request.HttpRequest.TLS != nil {
+		proto = "https"
+	}
+	host := request.HttpRequest.Host
+
+	if ph.XForwarded {
+		if ip != nil {
+			appendHeader(h, "X-Forwarded-For", ip.String())
+		}
+		if h.Get("X-Forwarded-Proto") == "" {
+			h.Set("X-Forwarded-Proto", proto)
+		}
+		if h.Get("X-Forwarded-Host") == "" && host != "" {
+			h.Set("X-Forwarded-Host", host)
+		}
+	}
+	if ph.Forwarded {
+		node := "unknown"
+		if ip != nil {
+			node = ip.String()
+			if ip.To4() == nil {
+				node = `"[` + node + `]"`
+			}
+		}
+		elem := "for=" + node
+		if host != "" {
+			elem += ";host=" + forwardedValue(host)
+		}
+		elem += ";proto=" + proto
+		appendHeader(h, "Forwarded", elem)
+	}
+	if ph.Via != "" {
+		major, minor := request.HttpRequest.ProtoMajor, request.HttpRequest.ProtoMinor
+		if major == 0 {
+			major, minor = 1, 1
+		}
+		appendHeader(h, "Via", fmt.Sprintf("%d.%d %s", major, minor, ph.Via))
+	}
+}
+
+// The address the request came from, or nil if it isn't known
+func clientIP(request *falcore.Request) net.IP {
+	if request.RemoteAddr != nil {
+		return request.RemoteAddr.IP
+	}
+	// No connection (ServeHTTP or testing)
+	addr := request.HttpRequest.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// Adds value to the comma separated list in header name
+func appendHeader(h http.Header, name, value string) {
+	if prior := h.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(name, value)
+}
+
+// Quotes v if it isn't a valid RFC 7239 token
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return fmt.Sprintf("%q", v)
+		}
+	}
+	return v
+}
+
+// Headers that only apply to a single connection.  RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Removes hop-by-hop headers, including the ones named in Connection
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,151 @@
+package filter
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/falcoretest"
+)
+
+// Returns an Upstream to a server that stores the headers it gets in seen
+func headerUpstream(t *testing.T, seen *atomic.Value) *Upstream {
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		seen.Store(req.HttpRequest.Header)
+		return falcore.StringResponse(req.HttpRequest, 200, http.Header{"Keep-Alive": {"timeout=5"}, "X-App": {"1"}}, "ok")
+	}))
+	u := NewUpstream(NewUpstreamTransport("localhost", falcoretest.NewServer(t, p).Server.Port(), time.Second, nil))
+	t.Cleanup(u.Transport.transport.CloseIdleConnections)
+	return u
+}
+
+func TestProxyHeaders(t *testing.T) {
+	var seen atomic.Value
+	u := headerUpstream(t, &seen)
+	u.ProxyHeaders.Forwarded = true
+	u.ProxyHeaders.TrustedProxies, _ = ParseCIDRs("10.0.0.0/8", "::1")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		expected   http.Header
+	}{
+		{
+			"untrusted",
+			"192.0.2.1:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"https"}, "Forwarded": {"for=1.2.3.4"}},
+			http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Host":  {"www.example.com"},
+				"Forwarded":         {"for=192.0.2.1;host=www.example.com;proto=http"},
+				"Via":               {"1.1 falcore"},
+			},
+		},
+		{
+			"trusted",
+			"10.1.1.1:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"https"}, "Forwarded": {"for=1.2.3.4"}, "Via": {"1.1 edge"}},
+			http.Header{
+				"X-Forwarded-For":   {"1.2.3.4, 10.1.1.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"www.example.com"},
+				"Forwarded":         {"for=1.2.3.4, for=10.1.1.1;host=www.example.com;proto=http"},
+				"Via":               {"1.1 edge, 1.1 falcore"},
+			},
+		},
+		{
+			"ipv6",
+			"[::1]:1234",
+			nil,
+			http.Header{
+				"X-Forwarded-For": {"::1"},
+				"Forwarded":       {`for="[::1]";host=www.example.com;proto=http`},
+			},
+		},
+		{
+			"hop-by-hop",
+			"192.0.2.1:1234",
+			http.Header{"Connection": {"close, X-Secret"}, "X-Secret": {"1"}, "Keep-Alive": {"300"}, "Proxy-Authorization": {"Basic Zm9v"}, "X-Other": {"1"}},
+			http.Header{"X-Secret": nil, "Keep-Alive": nil, "Proxy-Authorization": nil, "X-Other": {"1"}},
+		},
+	}
+	for _, test := range tests {
+		tmp, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+		tmp.RemoteAddr = test.remoteAddr
+		for k, v := range test.header {
+			tmp.Header[k] = v
+		}
+		_, res := falcore.TestWithRequest(tmp, u, nil)
+		if res.StatusCode != 200 {
+			t.Fatalf("%v: expected 200, got %v", test.name, res.StatusCode)
+		}
+		res.Body.Close()
+		if res.Header.Get("Keep-Alive") != "" || res.Header.Get("X-App") != "1" {
+			t.Errorf("%v: bad response headers %v", test.name, res.Header)
+		}
+		h := seen.Load().(http.Header)
+		for k, v := range test.expected {
+			if got := h.Get(k); got != http.Header(map[string][]string{k: v}).Get(k) {
+				t.Errorf("%v: expected %v %q, got %q", test.name, k, v, got)
+			}
+		}
+		if tmp.Header.Get("Via") != test.header.Get("Via") {
+			t.Errorf("%v: the client's request was changed", test.name)
+		}
+	}
+}
+
+// The default replaces forwarding headers from anyone and adds Via
+func TestProxyHeadersDefault(t *testing.T) {
+	ph := NewUpstream(NewUpstreamTransport("localhost", 1, 0, nil)).ProxyHeaders
+	if ph == nil || !ph.XForwarded || ph.Forwarded || ph.Via != "falcore" || len(ph.TrustedProxies) != 0 {
+		t.Fatalf("Unexpected default %+v", ph)
+	}
+
+	var seen atomic.Value
+	u := headerUpstream(t, &seen)
+	tmp, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	tmp.RemoteAddr = "10.0.0.1:1234"
+	tmp.Header.Set("X-Forwarded-For", "1.2.3.4")
+	tmp.Header.Set("Forwarded", "for=1.2.3.4")
+	_, res := falcore.TestWithRequest(tmp, u, nil)
+	res.Body.Close()
+	h := seen.Load().(http.Header)
+	if h.Get("X-Forwarded-For") != "10.0.0.1" || h.Get("Forwarded") != "" || h.Get("Via") != "1.1 falcore" {
+		t.Errorf("Unexpected headers %v", h)
+	}
+}
+
+func TestProxyHeadersDisabled(t *testing.T) {
+	var seen atomic.Value
+	u := headerUpstream(t, &seen)
+	u.ProxyHeaders = nil
+
+	tmp, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	tmp.RemoteAddr = "192.0.2.1:1234"
+	tmp.Header.Set("X-Forwarded-For", "1.2.3.4")
+	_, res := falcore.TestWithRequest(tmp, u, nil)
+	res.Body.Close()
+	h := seen.Load().(http.Header)
+	if h.Get("X-Forwarded-For") != "1.2.3.4" || h.Get("Via") != "" {
+		t.Errorf("Expected the headers to be left alone, got %v", h)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8", "192.0.2.1", "fd00::/8")
+	if err != nil || len(nets) != 3 || nets[1].String() != "192.0.2.1/32" {
+		t.Fatalf("Bad result %v %v", nets, err)
+	}
+	if _, err := ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("Expected an error")
+	}
+	if _, err := ParseCIDRs("nope"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
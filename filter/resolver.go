@@ -0,0 +1,16 @@
+package filter
+
+import (
+	"context"
+	"net"
+)
+
+// Looks up upstream hosts.  *net.Resolver implements it, and tests can use
+// a fake.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// Used by UpstreamTransports and SRVDiscovery without a Resolver
+var DefaultResolver Resolver = net.DefaultResolver
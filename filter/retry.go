@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// Controls how an UpstreamPool retries failed requests on another server.
+//
+// Connection failures are retried for any method since the server never
+// saw the request.  Other failures, like timeouts and dropped connections,
+// are only retried for idempotent methods (GET, HEAD, OPTIONS, TRACE, PUT
+// and DELETE) or requests with an Idempotency-Key or X-Idempotency-Key
+// header.  Responses from the server, even 5xx ones, aren't retried.
+//
+// Request bodies up to MaxBodySize are buffered so they can be replayed.
+// Requests with bigger bodies aren't retried.
+type RetryPolicy struct {
+	// Retries after the first attempt
+	MaxRetries int
+	// The nth retry waits about Backoff * 2^(n-1), up to MaxBackoff.  Half
+	// of the wait is random so retries from many requests spread out.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retries may be at most this fraction of requests, plus BudgetBurst.
+	// This keeps retries from piling on when every server is failing.  0
+	// means no limit.
+	Budget      float64
+	BudgetBurst int
+	MaxBodySize int64
+
+	budgetMutex sync.Mutex
+	// Starts full.  Each request adds Budget and each retry takes 1.
+	budgetTokens float64
+	budgetInit   bool
+}
+
+// A RetryPolicy with sensible defaults: 25ms backoff up to 1s, a budget
+// of 20% plus 10, and bodies up to 64KB.
+func NewRetryPolicy(maxRetries int) *RetryPolicy {
+	return &RetryPolicy{
+		MaxRetries:  maxRetries,
+		Backoff:     25 * time.Millisecond,
+		MaxBackoff:  time.Second,
+		Budget:      0.2,
+		BudgetBurst: 10,
+		MaxBodySize: 64 * 1024,
+	}
+}
+
+// Whether the method can safely be sent twice
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	// Same as net/http.Transport
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := req.Header["X-Idempotency-Key"]
+	return ok
+}
+
+// Whether err happened before anything was sent to the server
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+func (p *RetryPolicy) shouldRetry(req *falcore.Request, err error) bool {
+	if req.HttpRequest.Context().Err() != nil {
+		// Out of time or the client went away
+		return false
+	}
+	return isConnectError(err) || isIdempotent(req.HttpRequest)
+}
+
+// Called once per request
+func (p *RetryPolicy) deposit() {
+	if p.Budget <= 0 {
+		return
+	}
+	p.budgetMutex.Lock()
+	p.fillBudget()
+	p.budgetTokens += p.Budget
+	if max := float64(p.BudgetBurst + 1); p.budgetTokens > max {
+		p.budgetTokens = max
+	}
+	p.budgetMutex.Unlock()
+}
+
+// Returns false if the budget is used up
+func (p *RetryPolicy) withdraw() bool {
+	if p.Budget <= 0 {
+		return true
+	}
+	p.budgetMutex.Lock()
+	defer p.budgetMutex.Unlock()
+	p.fillBudget()
+	if p.budgetTokens < 1 {
+		return false
+	}
+	p.budgetTokens--
+	return true
+}
+
+// Must be called with budgetMutex held
+func (p *RetryPolicy) fillBudget() {
+	if !p.budgetInit {
+		p.budgetInit = true
+		p.budgetTokens = float64(p.BudgetBurst)
+	}
+}
+
+// Waits before retry n (from 0).  Returns false if the request's context
+// finished first.
+func (p *RetryPolicy) wait(req *falcore.Request, n int) bool {
+	d := p.Backoff << uint(n)
+	if d > p.MaxBackoff || d <= 0 {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return true
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-req.HttpRequest.Context().Done():
+		return false
+	}
+}
+
+// Reads the request body so it can be sent more than once.  Returns the
+// body, or ok false if it's too big.  The request's Body is left readable
+// either way.
+func (p *RetryPolicy) bufferBody(req *http.Request) (body []byte, ok bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > p.MaxBodySize {
+		return nil, false
+	}
+	orig := req.Body
+	body, err := ioutil.ReadAll(io.LimitReader(orig, p.MaxBodySize+1))
+	if err != nil || int64(len(body)) > p.MaxBodySize {
+		// Put back what was read, along with the error
+		req.Body = &passThruReadCloser{io.MultiReader(bytes.NewReader(body), orig), orig}
+		return nil, false
+	}
+	orig.Close()
+	return body, true
+}
+
+// Runs the request on up to MaxRetries + 1 servers.  Each attempt is
+// recorded as its own stage.  The pool's stage gets the Status of the last.
+func (up UpstreamPool) filterWithRetries(req *falcore.Request) (res *http.Response, err error) {
+	p := up.Retry
+	p.deposit()
+	body, replayable := p.bufferBody(req.HttpRequest)
+	poolStage := req.CurrentStage
+	tried := make(map[*UpstreamEntry]bool)
+	for n := 0; ; n++ {
+		ue, trial := up.choose(req, tried)
+		if ue == nil {
+			return nil, falcore.NewHTTPError(503, "", nil)
+		}
+		tried[ue] = true
+		if body != nil {
+			req.HttpRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.HttpRequest.ContentLength = int64(len(body))
+		}
+
+		stage := falcore.NewPiplineStage("*filter.Upstream")
+		stage.Type = falcore.PipelineStageTypeUpstream
+		req.CurrentStage = stage
+		res, err = up.attempt(req, ue, trial)
+		stage.EndTime = time.Now()
+		req.CurrentStage = poolStage
+		req.RecordPipelineStage(stage)
+		poolStage.Status = stage.Status
+
+		if err == nil || n >= p.MaxRetries || !replayable || !p.shouldRetry(req, err) {
+			return
+		}
+		if !p.withdraw() {
+			falcore.Warn("%s [%s] Retry budget exhausted", req.ID, up.Name)
+			return
+		}
+		falcore.Debug("%s [%s] Retrying after %v", req.ID, up.Name, err)
+		if !p.wait(req, n) {
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package filter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+	"github.com/fitstar/falcore/falcoretest"
+)
+
+// A port nothing is listening on
+func deadPort(t *testing.T) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+// A server that accepts connections and closes them without responding
+func hangupServer(t *testing.T) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Read(make([]byte, 1024))
+			c.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Echoes the request body
+func echoServer(t *testing.T) int {
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "echo:"+string(body))
+	}))
+	return falcoretest.NewServer(t, p).Server.Port()
+}
+
+// Shut down when the test finishes, before the servers it uses
+func retryPool(t *testing.T, policy *RetryPolicy, ports ...int) *UpstreamPool {
+	entries := make([]*UpstreamEntry, len(ports))
+	for i, port := range ports {
+		up := NewUpstream(NewUpstreamTransport("localhost", port, time.Second, nil))
+		up.Name = string(rune('a' + i))
+		entries[i] = &UpstreamEntry{Upstream: up, Weight: 1}
+	}
+	pool := NewUpstreamPool("retry", entries)
+	pool.Retry = policy
+	t.Cleanup(func() {
+		for _, ue := range entries {
+			ue.Upstream.Transport.transport.CloseIdleConnections()
+		}
+	})
+	return pool
+}
+
+// name:status for each stage
+func stageSummary(req *falcore.Request) string {
+	var stages []string
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		pss := e.Value.(*falcore.PipelineStageStat)
+		stages = append(stages, fmt.Sprintf("%v:%v", pss.Name, pss.Status))
+	}
+	return strings.Join(stages, " ")
+}
+
+func TestUpstreamPoolRetryConnectFailure(t *testing.T) {
+	pool := retryPool(t, NewRetryPolicy(2), deadPort(t), echoServer(t))
+
+	// Not idempotent, but it never got sent
+	tmp, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader("hello"))
+	req, res := falcore.TestWithRequest(tmp, pool, nil)
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %v", res.StatusCode)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "echo:hello" {
+		t.Errorf("Body wasn't replayed: %q", body)
+	}
+	expected := "*filter.UpstreamPool:0 *filter.Upstream[a]:2 *filter.Upstream[b]:0"
+	if s := stageSummary(req); s != expected {
+		t.Errorf("Expected stages %v, got %v", expected, s)
+	}
+}
+
+func TestUpstreamPoolRetryIdempotency(t *testing.T) {
+	for _, test := range []struct {
+		method   string
+		header   string
+		status   int
+		attempts int
+	}{
+		{"GET", "", 200, 2},
+		{"PUT", "", 200, 2},
+		{"POST", "", 502, 1},
+		{"POST", "Idempotency-Key", 200, 2},
+	} {
+		pool := retryPool(t, NewRetryPolicy(1), hangupServer(t), echoServer(t))
+		tmp, _ := http.NewRequest(test.method, "http://localhost/", strings.NewReader("x"))
+		if test.header != "" {
+			tmp.Header.Set(test.header, "123")
+		}
+		req, res := falcore.TestWithRequest(tmp, pool, nil)
+		if res.StatusCode != test.status {
+			t.Errorf("%v %v: expected %v, got %v", test.method, test.header, test.status, res.StatusCode)
+		}
+		if n := req.PipelineStageStats.Len() - 1; n != test.attempts {
+			t.Errorf("%v %v: expected %v attempts, got %v", test.method, test.header, test.attempts, stageSummary(req))
+		}
+		if res.Body != nil {
+			res.Body.Close()
+		}
+	}
+}
+
+func TestUpstreamPoolRetryLimits(t *testing.T) {
+	// Too big to replay
+	policy := NewRetryPolicy(1)
+	policy.MaxBodySize = 2
+	pool := retryPool(t, policy, deadPort(t), echoServer(t))
+	tmp, _ := http.NewRequest("POST", "http://localhost/", strings.NewReader("hello"))
+	if req, res := falcore.TestWithRequest(tmp, pool, nil); res.StatusCode != 502 || req.PipelineStageStats.Len() != 2 {
+		t.Errorf("Expected a single attempt, got %v %v", res.StatusCode, stageSummary(req))
+	}
+
+	// The budget allows a retry for every 4 requests and no burst
+	policy = NewRetryPolicy(1)
+	policy.Budget = 0.25
+	policy.BudgetBurst = 0
+	policy.Backoff = time.Millisecond
+	pool = retryPool(t, policy, deadPort(t), deadPort(t))
+	var attempts []int
+	for i := 0; i < 8; i++ {
+		tmp, _ := http.NewRequest("GET", "http://localhost/", nil)
+		req, _ := falcore.TestWithRequest(tmp, pool, nil)
+		attempts = append(attempts, req.PipelineStageStats.Len()-1)
+	}
+	if s := fmt.Sprint(attempts); s != "[1 1 1 2 1 1 1 2]" {
+		t.Errorf("Budget wasn't applied: %v", s)
+	}
+}
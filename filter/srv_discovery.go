@@ -0,0 +1,169 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// Keeps an UpstreamPool's servers in sync with a DNS SRV record.  See
+// UpstreamPool.Discover.
+//
+// Only the targets with the lowest priority are used.  Each gets its SRV
+// weight, or 1 if that's 0.  A failed lookup or an empty answer leaves the
+// pool as it is, so a DNS outage doesn't empty it.
+type SRVDiscovery struct {
+	// As for net.LookupSRV.  If Service and Proto are empty, Name is
+	// looked up directly, like "_http._tcp.example.com".
+	Service string
+	Proto   string
+	Name    string
+	// How often to look the record up
+	Interval time.Duration
+	// Defaults to DefaultResolver.  Also used for the targets' addresses
+	// by the default NewUpstream.
+	Resolver Resolver
+	// Creates the Upstream for a new target.  Defaults to an Upstream
+	// without a timeout.
+	NewUpstream func(host string, port int) *Upstream
+}
+
+// Looks up the record every 30s
+func NewSRVDiscovery(service, proto, name string) *SRVDiscovery {
+	return &SRVDiscovery{
+		Service:  service,
+		Proto:    proto,
+		Name:     name,
+		Interval: 30 * time.Second,
+	}
+}
+
+var errNoRecords = errors.New("no records")
+
+func (d *SRVDiscovery) resolver() Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return DefaultResolver
+}
+
+func (d *SRVDiscovery) newUpstream(host string, port int) *Upstream {
+	if d.NewUpstream != nil {
+		return d.NewUpstream(host, port)
+	}
+	ut := NewUpstreamTransport(host, port, 0, nil)
+	ut.Resolver = d.Resolver
+	return NewUpstream(ut)
+}
+
+// Adds and drains servers as the SRV record d describes changes, until
+// the pool is shut down.  The first lookup is done before Discover returns.
+// Servers that were already in the pool aren't touched.
+func (up UpstreamPool) Discover(d *SRVDiscovery) {
+	s := &srvSync{pool: up, d: d, entries: make(map[string]*UpstreamEntry)}
+	s.sync()
+	go s.run()
+}
+
+// The servers added by an SRVDiscovery, by target:port
+type srvSync struct {
+	pool    UpstreamPool
+	d       *SRVDiscovery
+	entries map[string]*UpstreamEntry
+}
+
+func (s *srvSync) run() {
+	interval := s.d.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-s.pool.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.sync()
+		}
+	}
+}
+
+func (s *srvSync) sync() {
+	ctx := context.Background()
+	if s.d.Interval > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.d.Interval)
+		defer cancel()
+	}
+	_, records, err := s.d.resolver().LookupSRV(ctx, s.d.Service, s.d.Proto, s.d.Name)
+	if err == nil && len(records) == 0 {
+		err = errNoRecords
+	}
+	if err != nil {
+		falcore.Error("[%s] SRV lookup of %v failed: %v", s.pool.Name, s.d.Name, err)
+		return
+	}
+
+	priority := records[0].Priority
+	for _, r := range records {
+		if r.Priority < priority {
+			priority = r.Priority
+		}
+	}
+	want := make(map[string]*net.SRV)
+	for _, r := range records {
+		if r.Priority == priority {
+			want[srvKey(r)] = r
+		}
+	}
+
+	changed := false
+	for key, ue := range s.entries {
+		if _, ok := want[key]; !ok {
+			s.pool.Drain(ue)
+			delete(s.entries, key)
+			changed = true
+		}
+	}
+	for key, r := range want {
+		weight := int(r.Weight)
+		if weight == 0 {
+			weight = 1
+		}
+		if ue, ok := s.entries[key]; ok {
+			s.pool.weightMutex.RLock()
+			old := ue.Weight
+			s.pool.weightMutex.RUnlock()
+			if old != weight {
+				s.pool.SetWeight(ue, weight)
+				changed = true
+			}
+			continue
+		}
+		u := s.d.newUpstream(strings.TrimSuffix(r.Target, "."), int(r.Port))
+		if u.Name == "" {
+			u.Name = key
+		}
+		ue := &UpstreamEntry{Upstream: u, Weight: weight}
+		if err := s.pool.Add(ue); err != nil {
+			falcore.Warn("[%s] Not adding %v: %v", s.pool.Name, key, err)
+			continue
+		}
+		falcore.Info("[%s] Added %v", s.pool.Name, key)
+		s.entries[key] = ue
+		changed = true
+	}
+	if changed {
+		s.pool.LogStatus()
+	}
+}
+
+func srvKey(r *net.SRV) string {
+	return fmt.Sprintf("%v:%v", strings.ToLower(strings.TrimSuffix(r.Target, ".")), r.Port)
+}
@@ -0,0 +1,71 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// name:weight for each server, sorted
+func poolSummary(pool *UpstreamPool) string {
+	var servers []string
+	for _, h := range pool.Health() {
+		servers = append(servers, fmt.Sprintf("%v:%v", h.Name, h.Weight))
+	}
+	sort.Strings(servers)
+	return fmt.Sprint(servers)
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	a, b := echoServer(t), echoServer(t)
+	r := newFakeResolver()
+	r.setIPs("a.test", "127.0.0.1")
+	r.setIPs("b.test", "127.0.0.1")
+	r.setSRV("_http._tcp.app.test",
+		&net.SRV{Target: "a.test.", Port: uint16(a), Priority: 10, Weight: 2},
+		&net.SRV{Target: "b.test.", Port: uint16(b), Priority: 20, Weight: 1},
+	)
+
+	pool := retryPool(t, nil)
+	defer pool.Shutdown()
+	d := NewSRVDiscovery("", "", "_http._tcp.app.test")
+	d.Resolver = r
+	d.Interval = 10 * time.Millisecond
+	pool.Discover(d)
+
+	expected := fmt.Sprintf("[a.test:%v:2]", a)
+	if s := poolSummary(pool); s != expected {
+		t.Fatalf("Expected %v, got %v", expected, s)
+	}
+	if ue := pool.Next(); ue == nil || ue.Upstream.Transport.host != "a.test" {
+		t.Fatalf("Bad server %v", ue)
+	}
+	if c, err := pool.Next().Upstream.Transport.dial(context.Background(), "tcp", ""); err != nil {
+		t.Errorf("Expected the target to be resolved with the fake: %v", err)
+	} else {
+		c.Close()
+	}
+
+	// Grows and changes weight
+	r.setSRV("_http._tcp.app.test",
+		&net.SRV{Target: "a.test.", Port: uint16(a), Priority: 10, Weight: 0},
+		&net.SRV{Target: "b.test.", Port: uint16(b), Priority: 10, Weight: 3},
+	)
+	expected = fmt.Sprintf("[a.test:%v:1 b.test:%v:3]", a, b)
+	waitFor(t, "grow", func() bool { return poolSummary(pool) == expected })
+
+	// A failed lookup changes nothing
+	r.setSRV("_http._tcp.app.test")
+	time.Sleep(30 * time.Millisecond)
+	if s := poolSummary(pool); s != expected {
+		t.Fatalf("Expected %v, got %v", expected, s)
+	}
+
+	// Shrinks
+	r.setSRV("_http._tcp.app.test", &net.SRV{Target: "b.test", Port: uint16(b), Weight: 1})
+	expected = fmt.Sprintf("[b.test:%v:1]", b)
+	waitFor(t, "shrink", func() bool { return poolSummary(pool) == expected })
+}
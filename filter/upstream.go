@@ -2,6 +2,7 @@ package filter
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/fitstar/falcore"
 	"io"
@@ -22,10 +23,15 @@ type Upstream struct {
 	// Name, if set, is used in logging and request stats
 	Name      string
 	Transport *UpstreamTransport
-	// Will ignore https on the incoming request and always upstream http
+	// Will ignore https on the incoming request and always upstream http,
+	// unless the Transport uses TLS
 	ForceHttp bool
-	// Ping URL Path-only for checking upness
+	// Ping URL Path-only for checking upness.  Used by UpstreamPools without
+	// a HealthCheck.
 	PingPath string
+	// X-Forwarded-*, Forwarded and Via.  nil leaves the client's headers
+	// alone.  Hop-by-hop headers are always removed.
+	ProxyHeaders *ProxyHeaders
 	// Throttling
 	throttleC        *sync.Cond
 	throttleMax      int64
@@ -33,15 +39,32 @@ type Upstream struct {
 	throttleQueue    int64
 }
 
+// The Upstream gets NewProxyHeaders, which trusts no proxies.  Behind a
+// load balancer that sets X-Forwarded-For, add it to
+// ProxyHeaders.TrustedProxies, or its headers are replaced and the
+// upstream sees the load balancer as the client.  Set ProxyHeaders to nil
+// to forward requests without them, as before.
 func NewUpstream(transport *UpstreamTransport) *Upstream {
 	u := new(Upstream)
 	u.Transport = transport
+	u.ProxyHeaders = NewProxyHeaders()
 	u.throttleC = sync.NewCond(new(sync.Mutex))
 	return u
 }
 
-func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response) {
-	var err error
+func (u *Upstream) FilterRequest(request *falcore.Request) *http.Response {
+	res, err := u.FilterRequestE(request)
+	if err != nil {
+		falcore.Error("%s [%s] Upstream error: %v", request.ID, u.Name, err)
+		return falcore.RenderError(request, err)
+	}
+	return res
+}
+
+// Implements falcore.RequestFilterE.  Connection failures are returned as a
+// 502 *falcore.HTTPError and timeouts as a 504.  CurrentStage.Status is set
+// to 2 (Fail) for both.
+func (u *Upstream) FilterRequestE(request *falcore.Request) (res *http.Response, err error) {
 	req := request.HttpRequest
 
 	if u.Name != "" {
@@ -71,10 +94,24 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 		req.URL.Scheme = "http"
 		req.URL.Host = req.Host
 	}
+	// The request may be sent more than once by an UpstreamPool, so the
+	// proxy headers go on a copy
+	out := new(http.Request)
+	*out = *req
+	out.Header = req.Header.Clone()
+	removeHopHeaders(out.Header)
+	if u.ProxyHeaders != nil {
+		u.ProxyHeaders.apply(request, out)
+	}
+	out.Header.Set("Connection", "Keep-Alive")
+	if u.Transport.TLS != nil {
+		url := *req.URL
+		url.Scheme = "https"
+		out.URL = &url
+	}
 	before := time.Now()
-	req.Header.Set("Connection", "Keep-Alive")
 	var upstrRes *http.Response
-	upstrRes, err = u.Transport.transport.RoundTrip(req)
+	upstrRes, err = u.Transport.transport.RoundTrip(out)
 	diff := falcore.TimeDiff(before, time.Now())
 	if err == nil {
 		// Copy response over to new record.  Remove connection noise.  Add some sanity.
@@ -106,30 +143,26 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 				res.ContentLength = 0
 			}
 		}
-		// Copy over headers with a few exceptions
-		res.Header = make(http.Header)
-		for hn, hv := range upstrRes.Header {
-			switch hn {
-			case "Content-Length":
-			case "Connection":
-			case "Transfer-Encoding":
-			default:
-				res.Header[hn] = hv
-			}
-		}
+		// Copy over headers except the hop-by-hop ones
+		res.Header = upstrRes.Header
+		removeHopHeaders(res.Header)
+		res.Header.Del("Content-Length")
 	} else {
+		// The pipeline logs these errors
 		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-			falcore.Error("%s [%s] Upstream Timeout error: %v", request.ID, u.Name, err)
-			res = falcore.StringResponse(req, 504, nil, "Gateway Timeout\n")
-			request.CurrentStage.Status = 2 // Fail
+			err = falcore.NewHTTPError(504, "", err)
+		} else if req.Context().Err() == context.DeadlineExceeded {
+			// Out of time for this request.  See falcore.TimeoutFilter
+			err = falcore.NewHTTPError(504, "", err)
 		} else {
-			falcore.Error("%s [%s] Upstream error: %v", request.ID, u.Name, err)
-			res = falcore.StringResponse(req, 502, nil, "Bad Gateway\n")
-			request.CurrentStage.Status = 2 // Fail
+			err = falcore.NewHTTPError(502, "", err)
 		}
+		request.CurrentStage.Status = 2 // Fail
+		falcore.Debug("%s %s [%s] [%s] %s err=%v Time=%.4f", request.ID, u.Name, req.Method, u.Transport.host, req.URL, err, diff)
+		return nil, err
 	}
 	falcore.Debug("%s %s [%s] [%s] %s s=%d Time=%.4f", request.ID, u.Name, req.Method, u.Transport.host, req.URL, res.StatusCode, diff)
-	return
+	return res, nil
 }
 
 // Set the maximum number of concurrent requests to send to upstream
@@ -156,31 +189,3 @@ func (u *Upstream) QueueLength() int64 {
 	u.throttleC.L.Unlock()
 	return ql
 }
-
-func (u *Upstream) ping() (up bool, ok bool) {
-	if u.PingPath != "" {
-		// the url must be syntactically valid for this to work but the host will be ignored because we
-		// are overriding the connection always
-		request, err := http.NewRequest("GET", "http://localhost"+u.PingPath, nil)
-		request.Header.Set("Connection", "Keep-Alive") // not sure if this should be here for a ping
-		if err != nil {
-			falcore.Error("Bad Ping request: %v", err)
-			return false, true
-		}
-		res, err := u.Transport.transport.RoundTrip(request)
-
-		if err != nil {
-			falcore.Error("[%s] Failed Ping to %v:%v: %v", u.Name, u.Transport.host, u.Transport.port, err)
-			return false, true
-		} else {
-			res.Body.Close()
-		}
-		if res.StatusCode == 200 {
-			return true, true
-		}
-		falcore.Error("[%s] Failed Ping to %v:%v: %v", u.Name, u.Transport.host, u.Transport.port, res.Status)
-		// bad status
-		return false, true
-	}
-	return false, false
-}
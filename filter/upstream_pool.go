@@ -1,161 +1,344 @@
 package filter
 
 import (
+	"errors"
 	"github.com/fitstar/falcore"
 	"net/http"
 	"sync"
 	"time"
 )
 
+// Returned by UpstreamPool.Add
+var ErrServerExists = errors.New("server is already in the pool")
+
+// How often Drain checks whether a server's requests have finished
+var drainPoll = 50 * time.Millisecond
+
+// A server in an UpstreamPool.  Weight is the configured share of traffic
+// and isn't changed by health checks.  0 disables the server.  Once the
+// entry is in a pool, change Weight with UpstreamPool.SetWeight.
 type UpstreamEntry struct {
 	Upstream *Upstream
 	Weight   int
+	// Guarded by the pool's weightMutex.  down is set by the active
+	// health check and health holds the passive state.
+	down     bool
+	draining bool
+	health   entryHealth
+	check    checkState
+}
+
+// Must be called with the pool's weightMutex held
+func (ue *UpstreamEntry) healthy() bool {
+	return !ue.down && ue.health.ejectedUntil.IsZero()
+}
+
+// Whether ue can get new requests at all.  Must be called with the pool's
+// weightMutex held.
+func (ue *UpstreamEntry) enabled() bool {
+	return ue.Weight > 0 && !ue.draining
 }
 
 // An UpstreamPool is a list of upstream servers which are considered
-// functionally equivalent.  The pool will round-robin the requests to the servers.
+// functionally equivalent.  Balancer chooses which of the healthy servers
+// gets each request and defaults to smooth weighted round-robin.  If every
+// enabled server is down, they're all tried anyway.
+//
+// Servers are taken out of rotation by Outlier, which watches the
+// responses, and by the active HealthCheck.  Without a HealthCheck,
+// Upstreams with a PingPath are checked the way they always have been.
+// Both have to agree a server is healthy for it to get requests.
+//
+// Servers can be added and removed while the pool is in use.  See Add,
+// Remove, Drain and SetWeight, and PoolAdmin for doing it over HTTP.
 type UpstreamPool struct {
-	pool         []*UpstreamEntry
-	rr_count     int
-	ping_count   int64
-	Name         string
-	nextUpstream chan *UpstreamEntry
-	shutdown     chan int
-	weightMutex  *sync.RWMutex
-	pinger       *time.Ticker
-}
-
-// The config consists of a map of the servers in the pool in the format host_or_ip:port
-// where port is optional and defaults to 80.  The map value is an int with the weight
-// only 0 and 1 are supported weights (0 disables a server and 1 enables it)
+	// Guarded by weightMutex.  The slice is replaced rather than modified
+	// so a copy of it can be used without the lock.
+	pool       *[]*UpstreamEntry
+	ping_count int64
+	Name       string
+	// Set these before the pool is used.  Retry is nil by default, which
+	// disables retries.  Outlier defaults to NewOutlierDetection and nil
+	// disables it.
+	Balancer    Balancer
+	Retry       *RetryPolicy
+	Outlier     *OutlierDetection
+	shutdown    chan int
+	weightMutex *sync.RWMutex
+	checks      *poolChecks
+}
+
+// upstreams are the servers in the pool.  Each starts out healthy.
+// Weights can be any non-negative integer; 0 disables a server.
 func NewUpstreamPool(name string, upstreams []*UpstreamEntry) *UpstreamPool {
 	up := new(UpstreamPool)
 	up.Name = name
-	up.nextUpstream = make(chan *UpstreamEntry)
+	up.Balancer = NewRoundRobinBalancer()
+	up.Outlier = NewOutlierDetection()
 	up.weightMutex = new(sync.RWMutex)
 	up.shutdown = make(chan int)
-	up.pinger = time.NewTicker(3 * time.Second) // 3s
-	up.pool = upstreams
+	up.checks = &poolChecks{changed: make(chan struct{}, 1)}
+	up.pool = &upstreams
 
-	go up.nextServer()
 	go up.pingUpstreams()
 
 	return up
 }
 
+// Returns the next server to use, or nil if every server is disabled or
+// the pool has been shut down
 func (up UpstreamPool) Next() *UpstreamEntry {
-	// TODO check in case all are down that we timeout
-	return <-up.nextUpstream
+	return up.pick(nil, nil)
+}
+
+// The servers in the pool, in the order they were added.  Including ones
+// that are draining.
+func (up UpstreamPool) Entries() []*UpstreamEntry {
+	up.weightMutex.RLock()
+	defer up.weightMutex.RUnlock()
+	return *up.pool
+}
+
+// Must be called with weightMutex held
+func (up UpstreamPool) contains(ue *UpstreamEntry) bool {
+	for _, e := range *up.pool {
+		if e == ue {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds ue to the pool.  It starts out healthy.  Returns ErrServerExists
+// if it's already in the pool, or another server has the same
+// Upstream.Name.
+func (up UpstreamPool) Add(ue *UpstreamEntry) error {
+	up.weightMutex.Lock()
+	defer up.weightMutex.Unlock()
+	for _, e := range *up.pool {
+		if e == ue || (ue.Upstream.Name != "" && e.Upstream.Name == ue.Upstream.Name) {
+			return ErrServerExists
+		}
+	}
+	entries := make([]*UpstreamEntry, len(*up.pool), len(*up.pool)+1)
+	copy(entries, *up.pool)
+	*up.pool = append(entries, ue)
+	return nil
+}
+
+// Takes ue out of the pool right away.  Requests already sent to it
+// finish.  Returns false if it wasn't in the pool.
+func (up UpstreamPool) Remove(ue *UpstreamEntry) bool {
+	up.weightMutex.Lock()
+	entries := make([]*UpstreamEntry, 0, len(*up.pool))
+	for _, e := range *up.pool {
+		if e != ue {
+			entries = append(entries, e)
+		}
+	}
+	found := len(entries) < len(*up.pool)
+	*up.pool = entries
+	up.weightMutex.Unlock()
+	if f, ok := up.Balancer.(BalancerForgetter); ok && found {
+		f.Forget(ue)
+	}
+	return found
+}
+
+// Stops sending new requests to ue and removes it once the ones it has
+// finish.  The returned channel is closed when it's gone.  nil if ue
+// isn't in the pool.
+func (up UpstreamPool) Drain(ue *UpstreamEntry) <-chan struct{} {
+	up.weightMutex.Lock()
+	found := up.contains(ue)
+	ue.draining = found || ue.draining
+	up.weightMutex.Unlock()
+	if !found {
+		return nil
+	}
+	falcore.Info("[%s] Draining %v:%v", up.Name, ue.Upstream.Transport.host, ue.Upstream.Transport.port)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// A request may have picked ue just before it started draining,
+		// so it always gets one poll
+		ticker := time.NewTicker(drainPoll)
+		defer ticker.Stop()
+	wait:
+		for {
+			select {
+			case <-up.shutdown:
+				break wait
+			case <-ticker.C:
+				if ue.Upstream.outstanding() == 0 {
+					break wait
+				}
+			}
+		}
+		up.Remove(ue)
+		ue.Upstream.Transport.transport.CloseIdleConnections()
+	}()
+	return done
+}
+
+// Changes ue's Weight.  0 disables it.  Returns false if ue isn't in the
+// pool or weight is negative.
+func (up UpstreamPool) SetWeight(ue *UpstreamEntry, weight int) bool {
+	if weight < 0 {
+		return false
+	}
+	up.weightMutex.Lock()
+	defer up.weightMutex.Unlock()
+	if !up.contains(ue) {
+		return false
+	}
+	ue.Weight = weight
+	return true
 }
 
 // Logs the current status of the pool
 func (up UpstreamPool) LogStatus() {
-	weightsBuffer := make([]int, len(up.pool))
-	// loop and save the weights so we don't lock for logging
+	// loop and save the state so we don't lock for logging
 	up.weightMutex.RLock()
-	for i, ue := range up.pool {
+	entries := *up.pool
+	weightsBuffer := make([]int, len(entries))
+	downBuffer := make([]bool, len(entries))
+	for i, ue := range entries {
 		weightsBuffer[i] = ue.Weight
+		downBuffer[i] = !ue.healthy()
 	}
 	up.weightMutex.RUnlock()
 	// Now do the logging
-	for i, ue := range up.pool {
-		falcore.Info("Upstream %v: %v:%v\t%v", up.Name, ue.Upstream.Transport.host, ue.Upstream.Transport.port, weightsBuffer[i])
+	for i, ue := range entries {
+		status := "up"
+		if downBuffer[i] {
+			status = "down"
+		}
+		falcore.Info("Upstream %v: %v:%v\t%v\t%v", up.Name, ue.Upstream.Transport.host, ue.Upstream.Transport.port, weightsBuffer[i], status)
 	}
 }
 
-func (up UpstreamPool) FilterRequest(req *falcore.Request) (res *http.Response) {
-	if len(up.pool) < 1 {
-		return falcore.StringResponse(req.HttpRequest, 503, nil, "Service Unavailable\n")
+// Whether ue is currently considered healthy
+func (up UpstreamPool) IsUp(ue *UpstreamEntry) bool {
+	up.weightMutex.RLock()
+	defer up.weightMutex.RUnlock()
+	return ue.healthy()
+}
+
+func (up UpstreamPool) FilterRequest(req *falcore.Request) *http.Response {
+	res, err := up.FilterRequestE(req)
+	if err != nil {
+		falcore.Error("%s [%s] UpstreamPool error: %v", req.ID, up.Name, err)
+		return falcore.RenderError(req, err)
 	}
+	return res
+}
 
-	ue := up.Next()
-	res = ue.Upstream.FilterRequest(req)
-	if req.CurrentStage.Status == 2 {
-		// this gets set by the upstream for errors
-		// so mark this upstream as down
-		up.updateUpstream(ue, 0)
-		up.LogStatus()
+// Implements falcore.RequestFilterE.  An empty pool is a 503
+// *falcore.HTTPError.  Upstream errors are passed through once Retry, if
+// it's set, gives up.
+func (up UpstreamPool) FilterRequestE(req *falcore.Request) (res *http.Response, err error) {
+	if len(up.Entries()) < 1 {
+		return nil, falcore.NewHTTPError(503, "", nil)
+	}
+	if up.Retry != nil {
+		return up.filterWithRetries(req)
+	}
+
+	ue, trial := up.choose(req, nil)
+	if ue == nil {
+		return nil, falcore.NewHTTPError(503, "", nil)
+	}
+	return up.attempt(req, ue, trial)
+}
+
+// Picks a server for req, preferring ones that haven't been tried.  An
+// ejected server due for a trial comes first.
+func (up UpstreamPool) choose(req *falcore.Request, tried map[*UpstreamEntry]bool) (ue *UpstreamEntry, trial bool) {
+	if ue = up.trialServer(tried); ue != nil {
+		return ue, true
+	}
+	return up.pick(req, tried), false
+}
+
+// Sends the request to ue and updates its health
+func (up UpstreamPool) attempt(req *falcore.Request, ue *UpstreamEntry, trial bool) (res *http.Response, err error) {
+	// A trial that panics still has to end or ue is never tried again
+	recorded := false
+	if trial {
+		defer func() {
+			if !recorded {
+				up.recordResult(req, ue, true, nil, errTrialAborted)
+			}
+		}()
 	}
+	before := time.Now()
+	res, err = ue.Upstream.FilterRequestE(req)
+	if o, ok := up.Balancer.(BalancerObserver); ok {
+		o.Observe(ue, time.Since(before), err)
+	}
+	up.recordResult(req, ue, trial, res, err)
+	recorded = true
 	return
 }
 
-func (up UpstreamPool) updateUpstream(ue *UpstreamEntry, wgt int) {
+// Mark ue up or down as the health check would.  Returns true if it
+// changed.
+func (up UpstreamPool) setUp(ue *UpstreamEntry, isUp bool) bool {
 	up.weightMutex.Lock()
-	ue.Weight = wgt
-	up.weightMutex.Unlock()
+	defer up.weightMutex.Unlock()
+	if ue.down != isUp {
+		return false
+	}
+	ue.down = !isUp
+	return true
 }
 
-// This should only be called if the upstream pool is no longer active or this may deadlock
+// Stops the pool's goroutines.  Requests after this get a 503.
 func (up UpstreamPool) Shutdown() {
-	// ping and nextServer
+	// stops ping and makes pick return nil
 	close(up.shutdown)
-
-	// make sure we hit the shutdown code in the nextServer goroutine
-	up.Next()
 }
 
-func (up UpstreamPool) nextServer() {
-	// Don't start up if there are no entries
-	if len(up.pool) < 1 {
-		return
+// Asks the Balancer to choose from the healthy, enabled servers that
+// haven't been tried, or failing that the healthy ones, or all of the
+// enabled servers.  nil if none are enabled or the pool has been shut down.
+func (up UpstreamPool) pick(req *falcore.Request, tried map[*UpstreamEntry]bool) *UpstreamEntry {
+	select {
+	case <-up.shutdown:
+		return nil
+	default:
 	}
-
-	loopCount := 0
-	for {
-		next := up.rr_count % len(up.pool)
-		up.weightMutex.RLock()
-		wgt := up.pool[next].Weight
-		up.weightMutex.RUnlock()
-		// just return a down host if we've gone through the list twice and nothing is up
-		// be sure to never return negative wgt hosts
-		if (wgt > 0 || (loopCount > 2*len(up.pool))) && wgt >= 0 {
-			loopCount = 0
-			select {
-			case <-up.shutdown:
-				return
-			case up.nextUpstream <- up.pool[next]:
-			}
-		} else {
-			loopCount++
+	// Held until the Balancer is done so it can read Weight
+	up.weightMutex.RLock()
+	defer up.weightMutex.RUnlock()
+	entries := *up.pool
+	servers := make([]*UpstreamEntry, 0, len(entries))
+	for _, ue := range entries {
+		if ue.enabled() && ue.healthy() && !tried[ue] {
+			servers = append(servers, ue)
 		}
-		up.rr_count++
-	}
-}
-
-func (up UpstreamPool) pingUpstreams() {
-	pingable := true
-	for pingable {
-		select {
-		case <-up.shutdown:
-			return
-		case <-up.pinger.C:
-			gotone := false
-			for i, ups := range up.pool {
-				if ups.Upstream.PingPath != "" {
-					go up.pingUpstream(ups, i)
-					gotone = true
-				}
-			}
-			if !gotone {
-				pingable = false
+	}
+	if len(servers) == 0 {
+		for _, ue := range entries {
+			if ue.enabled() && ue.healthy() {
+				servers = append(servers, ue)
 			}
 		}
 	}
-	falcore.Warn("Stopping ping for %v", up.Name)
-}
-
-func (up UpstreamPool) pingUpstream(ups *UpstreamEntry, index int) {
-	isUp, ok := ups.Upstream.ping()
-	up.weightMutex.RLock()
-	wgt := ups.Weight
-	up.weightMutex.RUnlock()
-	// change in status
-	if ok && (wgt > 0) != isUp {
-		if isUp {
-			up.updateUpstream(ups, 1)
-		} else {
-			up.updateUpstream(ups, 0)
+	if len(servers) == 0 {
+		for _, ue := range entries {
+			if ue.enabled() {
+				servers = append(servers, ue)
+			}
 		}
-		up.LogStatus()
 	}
+	if len(servers) == 0 {
+		return nil
+	}
+	if pb, ok := up.Balancer.(poolBalancer); ok {
+		return pb.pickFrom(req, entries, servers)
+	}
+	return up.Balancer.Pick(req, servers)
 }
@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+func testPool(weights ...int) (*UpstreamPool, []*UpstreamEntry) {
+	entries := make([]*UpstreamEntry, len(weights))
+	for i, w := range weights {
+		up := NewUpstream(NewUpstreamTransport("localhost", 9000+i, 0, nil))
+		up.Name = string(rune('a' + i))
+		entries[i] = &UpstreamEntry{Upstream: up, Weight: w}
+	}
+	return NewUpstreamPool("test", entries), entries
+}
+
+// Picks n servers and returns their names
+func pickSequence(pool *UpstreamPool, n int) string {
+	var names []string
+	for i := 0; i < n; i++ {
+		if ue := pool.pick(nil, nil); ue != nil {
+			names = append(names, ue.Upstream.Name)
+		} else {
+			names = append(names, "-")
+		}
+	}
+	return strings.Join(names, "")
+}
+
+func TestUpstreamPoolSmoothWeights(t *testing.T) {
+	pool, _ := testPool(5, 1, 1)
+	defer pool.Shutdown()
+	// The classic nginx example: spread out, not aaaaabc
+	if seq := pickSequence(pool, 14); seq != "aabacaaaabacaa" {
+		t.Errorf("Bad sequence %v", seq)
+	}
+
+	pool2, _ := testPool(3, 2, 0)
+	defer pool2.Shutdown()
+	counts := map[rune]int{}
+	for _, n := range pickSequence(pool2, 500) {
+		counts[n]++
+	}
+	if counts['a'] != 300 || counts['b'] != 200 || counts['c'] != 0 {
+		t.Errorf("Bad distribution %v", counts)
+	}
+}
+
+func TestUpstreamPoolHealth(t *testing.T) {
+	pool, entries := testPool(2, 1, 1)
+	defer pool.Shutdown()
+
+	pool.setUp(entries[0], false)
+	if seq := pickSequence(pool, 4); seq != "bcbc" {
+		t.Errorf("Down server was picked: %v", seq)
+	}
+	if entries[0].Weight != 2 || pool.IsUp(entries[0]) {
+		t.Errorf("Health should be separate from weight: %v %v", entries[0].Weight, pool.IsUp(entries[0]))
+	}
+
+	// Back up with its old weight
+	pool.setUp(entries[0], true)
+	if seq := pickSequence(pool, 8); strings.Count(seq, "a") != 4 {
+		t.Errorf("Weight wasn't restored: %v", seq)
+	}
+
+	// Everything down, try them anyway
+	for _, ue := range entries {
+		pool.setUp(ue, false)
+	}
+	if seq := pickSequence(pool, 4); seq != "abca" {
+		t.Errorf("Bad fallback sequence %v", seq)
+	}
+}
+
+func TestUpstreamPoolDisabled(t *testing.T) {
+	pool, _ := testPool(0, 0)
+	defer pool.Shutdown()
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	_, res := falcore.TestWithRequest(tmp, pool, nil)
+	if res.StatusCode != 503 {
+		t.Errorf("Expected 503, got %v", res.StatusCode)
+	}
+	if ue := pool.Next(); ue != nil {
+		t.Errorf("Expected no server, got %v", ue.Upstream.Name)
+	}
+}
+
+func TestUpstreamPoolMembership(t *testing.T) {
+	pool, entries := testPool(1, 1)
+	defer pool.Shutdown()
+	a, b := entries[0], entries[1]
+	c := &UpstreamEntry{Upstream: NewUpstream(NewUpstreamTransport("localhost", 9002, 0, nil)), Weight: 2}
+	c.Upstream.Name = "c"
+
+	if pool.Add(c) != nil || pool.Add(c) != ErrServerExists {
+		t.Fatalf("Expected c to be added once")
+	}
+	dup := &UpstreamEntry{Upstream: NewUpstream(NewUpstreamTransport("localhost", 9003, 0, nil)), Weight: 1}
+	dup.Upstream.Name = "c"
+	if pool.Add(dup) != ErrServerExists {
+		t.Fatalf("Expected names to be unique")
+	}
+	if s := pickSequence(pool, 4); s != "cabc" {
+		t.Errorf("Expected cabc, got %v", s)
+	}
+	if !pool.SetWeight(a, 0) || pool.SetWeight(a, -1) {
+		t.Fatalf("Bad SetWeight results")
+	}
+	if !pool.Remove(b) || pool.Remove(b) || pool.SetWeight(b, 1) {
+		t.Fatalf("Expected b to be removed once")
+	}
+	if s := pickSequence(pool, 2); s != "cc" {
+		t.Errorf("Expected cc, got %v", s)
+	}
+
+	// c has a request in flight
+	c.Upstream.throttleC.L.Lock()
+	c.Upstream.throttleInFlight++
+	c.Upstream.throttleC.L.Unlock()
+	pool.SetWeight(a, 1)
+	done := pool.Drain(c)
+	if s := pickSequence(pool, 2); s != "aa" {
+		t.Errorf("Expected a draining server to be skipped, got %v", s)
+	}
+	time.Sleep(3 * drainPoll)
+	select {
+	case <-done:
+		t.Fatalf("Drained with a request in flight")
+	default:
+	}
+	if h := pool.Health(); len(h) != 2 || !h[1].Draining || h[1].Healthy {
+		t.Errorf("Bad health %+v", h)
+	}
+	c.Upstream.throttleC.L.Lock()
+	c.Upstream.throttleInFlight--
+	c.Upstream.throttleC.L.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Drain didn't finish")
+	}
+	if len(pool.Entries()) != 1 || pool.Drain(c) != nil {
+		t.Errorf("Expected c to be gone")
+	}
+}
+
+// Run with -race
+func TestUpstreamPoolSetWeightRace(t *testing.T) {
+	for _, b := range []Balancer{NewRoundRobinBalancer(), NewLeastConnBalancer(), NewP2CBalancer(), NewEWMABalancer(), NewHashBalancer(nil)} {
+		pool, entries := testPool(1, 1, 1)
+		pool.Balancer = b
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 200; i++ {
+				pool.SetWeight(entries[i%3], i%3+1)
+			}
+			close(done)
+		}()
+		for i := 0; i < 200; i++ {
+			if pool.Next() == nil {
+				t.Fatalf("%T: expected a server", b)
+			}
+		}
+		<-done
+		pool.Shutdown()
+	}
+}
@@ -0,0 +1,127 @@
+package filter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fitstar/falcore"
+)
+
+// Creates a certificate for name signed by parent, or self signed if
+// parent is nil
+func testCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey.(*ecdsa.PrivateKey)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// A TLS server for backend.internal that requires a client certificate
+// from ca and replies with the protocol, SNI and client name
+func tlsBackend(t *testing.T, ca tls.Certificate) int {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v %v", r.Proto, r.TLS.ServerName, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.EnableHTTP2 = true
+	// Failed handshakes are expected
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, "backend.internal", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	ca := testCert(t, "Test CA", nil)
+	port := tlsBackend(t, ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	for _, test := range []struct {
+		name     string
+		http2    bool
+		client   bool
+		status   int
+		expected string
+	}{
+		{"http/1.1", false, true, 200, "HTTP/1.1 backend.internal proxy"},
+		{"h2", true, true, 200, "HTTP/2.0 backend.internal proxy"},
+		{"no client cert", false, false, 502, ""},
+	} {
+		ut := NewUpstreamTransport("127.0.0.1", port, time.Second, nil)
+		ut.TLS = &tls.Config{ServerName: "backend.internal", RootCAs: roots}
+		if test.client {
+			ut.TLS.Certificates = []tls.Certificate{testCert(t, "proxy", &ca)}
+		}
+		ut.HTTP2 = test.http2
+		u := NewUpstream(ut)
+
+		tmp, _ := http.NewRequest("GET", "/", nil)
+		tmp.Host = "www.example.com"
+		_, res := falcore.TestWithRequest(tmp, u, nil)
+		if res.StatusCode != test.status {
+			t.Errorf("%v: expected %v, got %v", test.name, test.status, res.StatusCode)
+		}
+		if body := readBody(res); test.expected != "" && body != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.name, test.expected, body)
+		}
+		ut.transport.CloseIdleConnections()
+	}
+}
+
+func TestUpstreamTLSUntrusted(t *testing.T) {
+	ca := testCert(t, "Test CA", nil)
+	port := tlsBackend(t, ca)
+	ut := NewUpstreamTransport("127.0.0.1", port, time.Second, nil)
+	// Not signed by a trusted CA
+	ut.TLS = &tls.Config{ServerName: "backend.internal"}
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	if _, res := falcore.TestWithRequest(tmp, NewUpstream(ut), nil); res.StatusCode != 502 {
+		t.Errorf("Expected 502, got %v", res.StatusCode)
+	}
+}
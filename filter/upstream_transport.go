@@ -1,10 +1,15 @@
 package filter
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/fitstar/falcore"
@@ -14,12 +19,24 @@ import (
 // connect to an upstream.
 type UpstreamTransport struct {
 	DNSCacheDuration time.Duration
+	// Connect with TLS.  ServerName, which is also sent for SNI, defaults
+	// to the host.  nil is plain http.  Set before the first request.
+	TLS *tls.Config
+	// Offer HTTP/2 to TLS upstreams
+	HTTP2 bool
+
+	// Looks up the host.  Defaults to DefaultResolver.
+	Resolver Resolver
+	// When a host has several addresses, how long to wait for one before
+	// also trying the next.  Defaults to 300ms.
+	FallbackDelay time.Duration
 
 	host string
 	port int
 
-	tcpaddr          *net.TCPAddr
-	tcpaddrCacheTime time.Time
+	dnsMutex       sync.Mutex
+	addrs          []net.IP
+	addrsCacheTime time.Time
 
 	transport *http.Transport
 	timeout   time.Duration
@@ -40,69 +57,220 @@ func NewUpstreamTransport(host string, port int, timeout time.Duration, transpor
 		ut.transport.MaxIdleConnsPerHost = 15
 	}
 
-	ut.transport.Dial = func(n, addr string) (c net.Conn, err error) {
-		return ut.dial(n, addr)
-	}
+	ut.transport.DialContext = ut.dial
+	ut.transport.DialTLSContext = ut.dialTLS
+	// Only matters if dialTLS negotiates h2
+	ut.transport.ForceAttemptHTTP2 = true
 
 	return ut
 }
 
-func (t *UpstreamTransport) dial(n, a string) (c net.Conn, err error) {
-	var addr *net.TCPAddr
-	addr, err = t.lookupIp()
+// Connects to the host, whatever addr says
+func (t *UpstreamTransport) dial(ctx context.Context, n, addr string) (c net.Conn, err error) {
+	ips, err := t.lookupIPs(ctx)
+	if err != nil {
+		falcore.Error("Lookup of %v failed: %v", t.host, err)
+		return nil, err
+	}
 
-	falcore.Fine("Dialing connection to %v", addr)
-	var ctcp *net.TCPConn
-	ctcp, err = net.DialTCP("tcp4", nil, addr)
+	falcore.Fine("Dialing connection to %v:%v %v", t.host, t.port, ips)
+	c, err = t.dialParallel(ctx, ips)
 	if err != nil {
 		falcore.Error("Dial Failed: %v", err)
-		return
+		return nil, err
 	}
 
 	// FIXME: Go1 has a race that causes problems with timeouts
 	// Recommend disabling until Go1.1
 	if t.timeout > 0 {
-		c = &timeoutConnWrapper{Conn: ctcp, timeout: t.timeout}
-	} else {
-		c = ctcp
+		c = &timeoutConnWrapper{Conn: c, timeout: t.timeout}
 	}
 
-	return
+	return c, nil
 }
 
-func (t *UpstreamTransport) lookupIp() (addr *net.TCPAddr, err error) {
-	// Cached tcpaddr
-	if t.tcpaddr != nil && (t.DNSCacheDuration == 0 || t.tcpaddrCacheTime.Add(t.DNSCacheDuration).After(time.Now())) {
-		return t.tcpaddr, nil
+// Happy eyeballs (RFC 8305).  The addresses are tried in order, switching
+// between IPv6 and IPv4, and each attempt gets FallbackDelay before the
+// next one starts alongside it.  A failure starts the next one right away.
+// The first connection wins.
+func (t *UpstreamTransport) dialParallel(ctx context.Context, ips []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	delay := t.FallbackDelay
+	if delay <= 0 {
+		delay = 300 * time.Millisecond
+	}
+	d := net.Dialer{Timeout: t.timeout}
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	// Buffered so the losers don't block
+	results := make(chan result, len(ips))
+	fallback := time.NewTimer(delay)
+	defer fallback.Stop()
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), strconv.Itoa(t.port))
+		next++
+		pending++
+		go func() {
+			c, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{c, err}
+		}()
+		fallback.Reset(delay)
 	}
 
-	ips, err := net.LookupIP(t.host)
-	var ip net.IP = nil
+	var firstErr error
+	start()
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close any connections that finish after cancel
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-fallback.C:
+			if next < len(ips) {
+				start()
+			}
+		}
+	}
+}
 
+// Dials like dial and does the TLS handshake
+func (t *UpstreamTransport) dialTLS(ctx context.Context, n, a string) (net.Conn, error) {
+	c, err := t.dial(ctx, n, a)
 	if err != nil {
 		return nil, err
 	}
+	config := new(tls.Config)
+	if t.TLS != nil {
+		config = t.TLS.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = t.host
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+		if t.HTTP2 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	tc := tls.Client(c, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		falcore.Error("TLS handshake with %v failed: %v", config.ServerName, err)
+		return nil, err
+	}
+	return tc, nil
+}
+
+// The scheme to send requests to this upstream with
+func (t *UpstreamTransport) scheme() string {
+	if t.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
 
-	// Find first IPv4 IP
-	for i := range ips {
-		ip = ips[i].To4()
-		if ip != nil {
-			break
+// Builds a TLS config for an UpstreamTransport.  caFile is a PEM bundle
+// that replaces the system roots.  certFile and keyFile are a client
+// certificate for mTLS.  Empty values are left unset.
+func LoadUpstreamTLS(serverName, caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", caFile)
 		}
 	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Returns the host's addresses in the order to try them, from the cache if
+// it's fresh
+func (t *UpstreamTransport) lookupIPs(ctx context.Context) ([]net.IP, error) {
+	if ip := net.ParseIP(t.host); ip != nil {
+		return []net.IP{ip}, nil
+	}
 
-	if ip != nil {
-		t.tcpaddr = &net.TCPAddr{}
-		t.tcpaddr.Port = t.port
-		t.tcpaddr.IP = ip
-		t.tcpaddrCacheTime = time.Now()
-		addr = t.tcpaddr
-	} else {
-		errstr := fmt.Sprintf("Can't get IP addr for %v: %v", t.host, err)
-		err = errors.New(errstr)
+	t.dnsMutex.Lock()
+	defer t.dnsMutex.Unlock()
+	// Cached addrs
+	if t.addrs != nil && (t.DNSCacheDuration == 0 || t.addrsCacheTime.Add(t.DNSCacheDuration).After(time.Now())) {
+		return t.addrs, nil
+	}
+
+	resolver := t.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, t.host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("Can't get IP addr for %v", t.host)
 	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	t.addrs = interleaveFamilies(ips)
+	t.addrsCacheTime = time.Now()
+	return t.addrs, nil
+}
 
-	return
+// Reorders ips to alternate between address families, starting with the
+// family of the first one
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	isV4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == isV4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
 }
 
 type timeoutConnWrapper struct {
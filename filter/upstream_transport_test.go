@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Resolver with canned answers
+type fakeResolver struct {
+	mutex   sync.Mutex
+	ips     map[string][]net.IPAddr
+	srvs    map[string][]*net.SRV
+	lookups int
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{ips: make(map[string][]net.IPAddr), srvs: make(map[string][]*net.SRV)}
+}
+
+func (r *fakeResolver) setIPs(host string, ips ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.ips[host] = nil
+	for _, ip := range ips {
+		r.ips[host] = append(r.ips[host], net.IPAddr{IP: net.ParseIP(ip)})
+	}
+}
+
+func (r *fakeResolver) setSRV(name string, srvs ...*net.SRV) {
+	r.mutex.Lock()
+	r.srvs[name] = srvs
+	r.mutex.Unlock()
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookups++
+	if ips, ok := r.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if srvs, ok := r.srvs[name]; ok {
+		return name, srvs, nil
+	}
+	return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"::1", "::2", "::3", "10.0.0.1", "10.0.0.2"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+	expected := "[::1 10.0.0.1 ::2 10.0.0.2 ::3]"
+	if s := fmt.Sprint(interleaveFamilies(ips)); s != expected {
+		t.Errorf("Expected %v, got %v", expected, s)
+	}
+}
+
+func TestUpstreamTransportDial(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	r := newFakeResolver()
+	// Nothing answers at the first address
+	r.setIPs("backend.test", "192.0.2.1", "127.0.0.1")
+	ut := NewUpstreamTransport("backend.test", port, time.Second, nil)
+	ut.Resolver = r
+	ut.FallbackDelay = 20 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		c, err := ut.dial(context.Background(), "tcp", "")
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		if addr := c.RemoteAddr().String(); addr != l.Addr().String() {
+			t.Errorf("Connected to %v", addr)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("Fallback took %v", d)
+		}
+		c.Close()
+	}
+	if r.lookups != 1 {
+		t.Errorf("Expected the addresses to be cached, got %v lookups", r.lookups)
+	}
+
+	ut.DNSCacheDuration = time.Nanosecond
+	r.setIPs("backend.test")
+	if _, err := ut.dial(context.Background(), "tcp", ""); err == nil {
+		t.Errorf("Expected an error without addresses")
+	}
+	r.setIPs("backend.test", "127.0.0.1")
+	if _, err := ut.dial(context.Background(), "tcp", ""); err != nil {
+		t.Errorf("Dial failed: %v", err)
+	}
+}
+
+func TestUpstreamTransportIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("No IPv6: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	r := newFakeResolver()
+	r.setIPs("backend.test", "::1")
+	ut := NewUpstreamTransport("backend.test", l.Addr().(*net.TCPAddr).Port, time.Second, nil)
+	ut.Resolver = r
+	c, err := ut.dial(context.Background(), "tcp", "")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,319 @@
+package falcore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Returned by Hijack when the connection can't be taken over, either
+// because the Server doesn't own it or the response has already started.
+var ErrNotHijackable = errors.New("falcore: connection can't be hijacked")
+
+// Runs an http.Handler and returns what it writes as a response.  The
+// handler runs on its own goroutine so the body can be streamed while it's
+// still writing.  This returns as soon as the handler starts writing the
+// body, flushes, or returns.  A handler that doesn't call WriteHeader or
+// Write gets a 500.
+//
+// The response keeps the request's protocol and keep-alive.  An explicit
+// Content-Length header is used as the length; otherwise the length is
+// unknown and the body is chunked.  The ResponseWriter also implements:
+//
+//	http.Flusher        Flush pushes everything written so far to the client
+//	http.Hijacker       when the Server owns the connection, or the
+//	                    http.ResponseWriter given to Server.ServeHTTP can
+//	http.CloseNotifier  fires when HttpRequest.Context() is done
+func ServeHandler(req *Request, handler http.Handler) *http.Response {
+	rw := newPopulateResponseWriter(req)
+	go func() {
+		defer rw.finish()
+		handler.ServeHTTP(rw, req.HttpRequest)
+	}()
+	return <-rw.ch
+}
+
+// Copy the status and headers of res to wr
+func writeResponseHeader(wr http.ResponseWriter, res *http.Response) {
+	theHeader := wr.Header()
+	for key, header := range res.Header {
+		theHeader[key] = header
+	}
+
+	// Handle Content-Length
+	if res.ContentLength >= 0 {
+		theHeader.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+
+	wr.WriteHeader(res.StatusCode)
+}
+
+// Take over the connection.  The Server won't write a response or read
+// any more requests from it.
+func (fReq *Request) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if fReq.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	c, brw, err := fReq.hijacker()
+	if err == nil {
+		fReq.hijacked = true
+	}
+	return c, brw, err
+}
+
+// Push what's been written to the client.  Only called by the goroutine
+// writing the response.
+func (fReq *Request) flushResponse() error {
+	if fReq.responseFlusher == nil {
+		return nil
+	}
+	return fReq.responseFlusher()
+}
+
+// Adapted from net/http/filetransport.go
+func newPopulateResponseWriter(req *Request) *populateResponse {
+	hreq := req.HttpRequest
+	body := newHandlerBody(req)
+	return &populateResponse{
+		req:  req,
+		ch:   make(chan *http.Response, 1),
+		body: body,
+		done: make(chan struct{}),
+		res: &http.Response{
+			Proto:      hreq.Proto,
+			ProtoMajor: hreq.ProtoMajor,
+			ProtoMinor: hreq.ProtoMinor,
+			Header:     make(http.Header),
+			Body:       body,
+			Request:    hreq,
+		},
+	}
+}
+
+// populateResponse is a ResponseWriter that populates the *Response
+// in res, and writes its body to a pipe connected to the response
+// body. Once writes begin or finish() is called, the response is sent
+// on ch.
+type populateResponse struct {
+	req          *Request
+	res          *http.Response
+	ch           chan *http.Response
+	wroteHeader  bool
+	hasContent   bool
+	sentResponse bool
+	body         *handlerBody
+	// Closed when the handler returns
+	done chan struct{}
+	// Set when the handler passed the request on without responding.
+	// finish sends nil instead of a 500.
+	fellThrough bool
+}
+
+func (pr *populateResponse) finish() {
+	defer close(pr.done)
+	if pr.fellThrough && !pr.wroteHeader {
+		pr.fail(nil)
+		return
+	}
+	if !pr.wroteHeader {
+		pr.WriteHeader(500)
+	}
+	if !pr.sentResponse {
+		pr.sendResponse()
+	}
+	pr.body.closeWrite(nil)
+}
+
+// Use res as the response.  Nothing must have been sent yet.
+func (pr *populateResponse) fail(res *http.Response) {
+	pr.sentResponse = true
+	pr.body.closeWrite(nil)
+	pr.ch <- res
+}
+
+func (pr *populateResponse) sendResponse() {
+	if pr.sentResponse {
+		return
+	}
+	pr.sentResponse = true
+
+	if cl := pr.res.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			pr.res.ContentLength = n
+		}
+		pr.res.Header.Del("Content-Length")
+	} else if pr.hasContent {
+		pr.res.ContentLength = -1
+	}
+	if strings.ToLower(pr.res.Header.Get("Connection")) == "close" {
+		pr.res.Close = true
+	}
+	pr.ch <- pr.res
+}
+
+func (pr *populateResponse) Header() http.Header {
+	return pr.res.Header
+}
+
+func (pr *populateResponse) WriteHeader(code int) {
+	if pr.wroteHeader {
+		return
+	}
+	pr.wroteHeader = true
+
+	pr.res.StatusCode = code
+	pr.res.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+}
+
+func (pr *populateResponse) Write(p []byte) (n int, err error) {
+	if !pr.wroteHeader {
+		pr.WriteHeader(http.StatusOK)
+	}
+	pr.hasContent = true
+	if !pr.sentResponse {
+		pr.sendResponse()
+	}
+	return pr.body.Write(p)
+}
+
+// Implements http.Flusher
+func (pr *populateResponse) Flush() {
+	if !pr.wroteHeader {
+		pr.WriteHeader(http.StatusOK)
+	}
+	// The rest of the body is streamed
+	pr.hasContent = true
+	if !pr.sentResponse {
+		pr.sendResponse()
+	}
+	pr.body.flush()
+}
+
+// Implements http.Hijacker
+func (pr *populateResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if pr.sentResponse {
+		return nil, nil, ErrNotHijackable
+	}
+	c, brw, err := pr.req.hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Let the Pipeline finish.  The Server discards the response.
+	pr.wroteHeader = true
+	pr.fail(SimpleResponse(pr.req.HttpRequest, http.StatusSwitchingProtocols, nil, 0, nil))
+	return c, brw, nil
+}
+
+// Implements http.CloseNotifier
+func (pr *populateResponse) CloseNotify() <-chan bool {
+	ch := make(chan bool, 1)
+	go func() {
+		select {
+		case <-pr.req.HttpRequest.Context().Done():
+			ch <- true
+		case <-pr.done:
+		}
+	}()
+	return ch
+}
+
+// The body of a response written by an http.Handler.  It works like
+// io.Pipe, but the writer can also ask the reader, which is the goroutine
+// writing the response, to flush it to the client between writes.
+type handlerBody struct {
+	req     *Request
+	data    chan []byte
+	n       chan int
+	flushc  chan struct{}
+	flushed chan struct{}
+	// closed by the reader
+	closed    chan struct{}
+	closeOnce sync.Once
+	// closed by the writer, after setting werr
+	wdone     chan struct{}
+	wOnce     sync.Once
+	werr      error
+	flushLock sync.Mutex
+}
+
+func newHandlerBody(req *Request) *handlerBody {
+	return &handlerBody{
+		req:     req,
+		data:    make(chan []byte),
+		n:       make(chan int),
+		flushc:  make(chan struct{}),
+		flushed: make(chan struct{}),
+		closed:  make(chan struct{}),
+		wdone:   make(chan struct{}),
+	}
+}
+
+func (b *handlerBody) Read(p []byte) (int, error) {
+	for {
+		select {
+		case buf := <-b.data:
+			n := copy(p, buf)
+			b.n <- n
+			return n, nil
+		case <-b.flushc:
+			if err := b.req.flushResponse(); err != nil {
+				Debug("%s Error flushing response: %v", b.req.ID, err)
+			}
+			b.flushed <- struct{}{}
+		case <-b.wdone:
+			if b.werr != nil {
+				return 0, b.werr
+			}
+			return 0, io.EOF
+		case <-b.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+func (b *handlerBody) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+func (b *handlerBody) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		select {
+		case b.data <- p:
+			n := <-b.n
+			p = p[n:]
+			total += n
+		case <-b.closed:
+			return total, io.ErrClosedPipe
+		}
+	}
+	return total, nil
+}
+
+// Blocks until the reader has flushed everything written before it
+func (b *handlerBody) flush() {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+	select {
+	case b.flushc <- struct{}{}:
+		select {
+		case <-b.flushed:
+		case <-b.closed:
+		}
+	case <-b.closed:
+	}
+}
+
+func (b *handlerBody) closeWrite(err error) {
+	b.wOnce.Do(func() {
+		b.werr = err
+		close(b.wdone)
+	})
+}
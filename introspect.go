@@ -0,0 +1,178 @@
+package falcore
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Routers, and any RequestFilter that delegates to other filters, can
+// implement this interface so their branches show up in InspectPipeline.
+type PipelineBrancher interface {
+	PipelineBranches() []PipelineBranch
+}
+
+// One possible destination of a Router.  Label describes when it's chosen,
+// such as a path regexp or a host name.
+type PipelineBranch struct {
+	Label  string
+	Filter RequestFilter
+}
+
+// The kinds of PipelineNode
+const (
+	PipelineNodePipeline       = "pipeline"
+	PipelineNodeRequestFilter  = "request_filter"
+	PipelineNodeResponseFilter = "response_filter"
+	PipelineNodeRouter         = "router"
+	PipelineNodeCycle          = "cycle"
+	PipelineNodeInvalid        = "invalid"
+)
+
+// A description of one stage in a Pipeline and everything below it.
+// Name is the stage name used in PipelineStageStats.
+type PipelineNode struct {
+	Name       string          `json:"name"`
+	Kind       string          `json:"kind"`
+	Upstream   []*PipelineNode `json:"upstream,omitempty"`
+	Downstream []*PipelineNode `json:"downstream,omitempty"`
+	Finally    []*PipelineNode `json:"finally,omitempty"`
+	Branches   []*BranchNode   `json:"branches,omitempty"`
+}
+
+// A labeled edge from a router to one of its branches
+type BranchNode struct {
+	Label string        `json:"label"`
+	Node  *PipelineNode `json:"node"`
+}
+
+// Walk p and all nested Pipelines and Routers to describe its shape.
+// Routers are only followed if they implement PipelineBrancher.
+// A Pipeline that contains itself is reported as a "cycle" node
+// instead of being walked again.
+func InspectPipeline(p *Pipeline) *PipelineNode {
+	return inspectStage(p, make(map[*Pipeline]bool))
+}
+
+func inspectStage(stage interface{}, path map[*Pipeline]bool) *PipelineNode {
+	if stage == nil {
+		return &PipelineNode{Name: "<nil>", Kind: PipelineNodeInvalid}
+	}
+	node := &PipelineNode{Name: reflect.TypeOf(stage).String()}
+	switch s := stage.(type) {
+	case *Pipeline:
+		if path[s] {
+			node.Kind = PipelineNodeCycle
+			return node
+		}
+		path[s] = true
+		defer delete(path, s)
+		node.Kind = PipelineNodePipeline
+		for e := s.Upstream.Front(); e != nil; e = e.Next() {
+			node.Upstream = append(node.Upstream, inspectStage(e.Value, path))
+		}
+		node.Downstream = inspectResponseFilters(s.Downstream)
+		node.Finally = inspectResponseFilters(s.Finally)
+		return node
+	case Router:
+		node.Kind = PipelineNodeRouter
+	case RequestFilter:
+		node.Kind = PipelineNodeRequestFilter
+	default:
+		node.Kind = PipelineNodeInvalid
+		return node
+	}
+	if b, ok := stage.(PipelineBrancher); ok {
+		for _, branch := range b.PipelineBranches() {
+			child := inspectStage(branch.Filter, path)
+			node.Branches = append(node.Branches, &BranchNode{Label: branch.Label, Node: child})
+		}
+	}
+	return node
+}
+
+func inspectResponseFilters(l *list.List) (nodes []*PipelineNode) {
+	if l == nil {
+		return nil
+	}
+	for e := l.Front(); e != nil; e = e.Next() {
+		child := &PipelineNode{Name: reflect.TypeOf(e.Value).String(), Kind: PipelineNodeResponseFilter}
+		switch e.Value.(type) {
+		case ResponseFilter, ResponseFilterE, ResponseReplacer:
+		default:
+			child.Kind = PipelineNodeInvalid
+		}
+		nodes = append(nodes, child)
+	}
+	return nodes
+}
+
+// Write the tree as indented JSON
+func (n *PipelineNode) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Write the tree as a Graphviz DOT digraph.  Render it with something
+// like: dot -Tsvg pipeline.dot > pipeline.svg
+func (n *PipelineNode) WriteDOT(w io.Writer) error {
+	d := &dotWriter{w: w}
+	d.printf("digraph pipeline {\n\trankdir=LR;\n\tnode [fontname=\"Helvetica\"];\n")
+	d.node(n)
+	d.printf("}\n")
+	return d.err
+}
+
+type dotWriter struct {
+	w     io.Writer
+	err   error
+	count int
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var dotShapes = map[string]string{
+	PipelineNodePipeline:       "box3d",
+	PipelineNodeRequestFilter:  "box",
+	PipelineNodeResponseFilter: "box",
+	PipelineNodeRouter:         "diamond",
+	PipelineNodeCycle:          "doubleoctagon",
+	PipelineNodeInvalid:        "octagon",
+}
+
+func (d *dotWriter) printf(format string, args ...interface{}) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+// Writes n and its children.  Returns n's node id.
+func (d *dotWriter) node(n *PipelineNode) string {
+	id := fmt.Sprintf("n%d", d.count)
+	d.count++
+	style := ""
+	if n.Kind == PipelineNodeResponseFilter {
+		style = " style=dashed"
+	}
+	d.printf("\t%s [label=\"%s\" shape=%s%s];\n", id, dotEscaper.Replace(n.Name), dotShapes[n.Kind], style)
+	for i, c := range n.Upstream {
+		d.printf("\t%s -> %s [label=\"up %d\"];\n", id, d.node(c), i)
+	}
+	for i, c := range n.Downstream {
+		d.printf("\t%s -> %s [label=\"down %d\" style=dashed];\n", id, d.node(c), i)
+	}
+	for i, c := range n.Finally {
+		d.printf("\t%s -> %s [label=\"finally %d\" style=dashed];\n", id, d.node(c), i)
+	}
+	for _, b := range n.Branches {
+		d.printf("\t%s -> %s [label=\"%s\"];\n", id, d.node(b.Node), dotEscaper.Replace(b.Label))
+	}
+	return id
+}
@@ -0,0 +1,79 @@
+package falcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type branchingRouter struct {
+	branches []PipelineBranch
+}
+
+func (r *branchingRouter) SelectPipeline(req *Request) RequestFilter {
+	return nil
+}
+
+func (r *branchingRouter) PipelineBranches() []PipelineBranch {
+	return r.branches
+}
+
+func TestInspectPipeline(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilter(successFilter))
+	inner.Downstream.PushBack(NewResponseFilter(sumResponseFilter))
+
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(sumFilter))
+	p.Upstream.PushBack(&branchingRouter{[]PipelineBranch{{"inner", inner}, {"loop", p}}})
+	p.Upstream.PushBack("not a filter")
+
+	node := InspectPipeline(p)
+	if node.Kind != PipelineNodePipeline || len(node.Upstream) != 3 {
+		t.Fatalf("Bad root node: %+v", node)
+	}
+	if k := node.Upstream[0].Kind; k != PipelineNodeRequestFilter {
+		t.Errorf("Expected request filter, got %v", k)
+	}
+	if k := node.Upstream[2].Kind; k != PipelineNodeInvalid {
+		t.Errorf("Expected invalid, got %v", k)
+	}
+	router := node.Upstream[1]
+	if router.Kind != PipelineNodeRouter || len(router.Branches) != 2 {
+		t.Fatalf("Bad router node: %+v", router)
+	}
+	if b := router.Branches[0]; b.Label != "inner" || len(b.Node.Upstream) != 1 || len(b.Node.Downstream) != 1 {
+		t.Errorf("Bad inner branch: %+v", b.Node)
+	}
+	if k := router.Branches[1].Node.Kind; k != PipelineNodeCycle {
+		t.Errorf("Expected cycle, got %v", k)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := node.WriteJSON(buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var decoded PipelineNode
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded.Upstream) != 3 {
+		t.Errorf("Bad JSON: %v %s", err, buf)
+	}
+
+	buf.Reset()
+	if err := node.WriteDOT(buf); err != nil {
+		t.Fatalf("WriteDOT: %v", err)
+	}
+	dot := buf.String()
+	if !strings.HasPrefix(dot, "digraph pipeline {") || !strings.Contains(dot, `[label="inner"]`) {
+		t.Errorf("Bad DOT output:\n%v", dot)
+	}
+}
+
+func TestInspectPipelineNilBranch(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(&branchingRouter{[]PipelineBranch{{"nothing", nil}}})
+	node := InspectPipeline(p)
+	if k := node.Upstream[0].Branches[0].Node.Kind; k != PipelineNodeInvalid {
+		t.Errorf("Expected invalid, got %v", k)
+	}
+}
@@ -0,0 +1,94 @@
+package falcore
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Tracks the requests running on one version of the server's Pipeline
+// so we know when a replaced Pipeline is no longer in use.
+type pipelineRef struct {
+	pipeline  *Pipeline
+	active    int64
+	retired   int32
+	drained   func(old *Pipeline)
+	drainOnce sync.Once
+}
+
+func (r *pipelineRef) release() {
+	if atomic.AddInt64(&r.active, -1) == 0 && atomic.LoadInt32(&r.retired) == 1 {
+		r.finish()
+	}
+}
+
+// Mark the ref as replaced.  drained is called once there are
+// no more requests using it.
+func (r *pipelineRef) retire(drained func(old *Pipeline)) {
+	r.drained = drained
+	atomic.StoreInt32(&r.retired, 1)
+	if atomic.LoadInt64(&r.active) == 0 {
+		r.finish()
+	}
+}
+
+func (r *pipelineRef) finish() {
+	r.drainOnce.Do(func() {
+		if r.drained != nil {
+			r.drained(r.pipeline)
+		}
+	})
+}
+
+// Returns the live pipeline with its request count incremented.
+// The caller must release() it when the request is complete.
+func (srv *Server) acquirePipeline() *pipelineRef {
+	for {
+		r := srv.loadPipelineRef()
+		atomic.AddInt64(&r.active, 1)
+		// Make sure it wasn't swapped out from under us before we
+		// were counted.  If it was, try again with the new one.
+		if srv.loadPipelineRef() == r {
+			return r
+		}
+		r.release()
+	}
+}
+
+func (srv *Server) loadPipelineRef() *pipelineRef {
+	if r, ok := srv.livePipeline.Load().(*pipelineRef); ok {
+		return r
+	}
+	// First request.  Start with the Pipeline the server was created with.
+	srv.livePipelineM.Lock()
+	defer srv.livePipelineM.Unlock()
+	if r, ok := srv.livePipeline.Load().(*pipelineRef); ok {
+		return r
+	}
+	r := &pipelineRef{pipeline: srv.Pipeline}
+	srv.livePipeline.Store(r)
+	return r
+}
+
+// Atomically replace the Pipeline used for new requests.  Requests
+// already in progress, including writing their response, finish on the
+// old Pipeline.  Once the last of them is complete, drained is called
+// with the old Pipeline.  This is where resources such as
+// filter.UpstreamPool should be shut down.  drained may be nil.
+//
+// Returns the Pipeline that was replaced.  After SetPipeline has been
+// called, Server.Pipeline is no longer updated; use CurrentPipeline.
+func (srv *Server) SetPipeline(pipeline *Pipeline, drained func(old *Pipeline)) *Pipeline {
+	// make sure the initial pipeline is in place
+	srv.loadPipelineRef()
+	srv.livePipelineM.Lock()
+	old := srv.livePipeline.Load().(*pipelineRef)
+	srv.livePipeline.Store(&pipelineRef{pipeline: pipeline})
+	srv.livePipelineM.Unlock()
+	old.retire(drained)
+	return old.pipeline
+}
+
+// Returns the Pipeline being used for new requests
+func (srv *Server) CurrentPipeline() *Pipeline {
+	return srv.loadPipelineRef().pipeline
+}
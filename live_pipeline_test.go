@@ -0,0 +1,76 @@
+package falcore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetPipelineDrain(t *testing.T) {
+	started := make(chan bool)
+	unblock := make(chan bool)
+	oldPipe := NewPipeline()
+	oldPipe.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		started <- true
+		<-unblock
+		return StringResponse(req.HttpRequest, 200, nil, "old")
+	}))
+	newPipe := NewPipeline()
+	newPipe.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "new")
+	}))
+	srv := NewServer(0, oldPipe)
+
+	serve := func() string {
+		req := httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	oldDone := make(chan string)
+	go func() {
+		oldDone <- serve()
+	}()
+	<-started
+
+	drained := make(chan *Pipeline, 1)
+	if prev := srv.SetPipeline(newPipe, func(old *Pipeline) { drained <- old }); prev != oldPipe {
+		t.Errorf("SetPipeline returned the wrong pipeline")
+	}
+	if srv.CurrentPipeline() != newPipe {
+		t.Errorf("CurrentPipeline wasn't updated")
+	}
+
+	if body := serve(); body != "new" {
+		t.Errorf("New request went to the old pipeline: %v", body)
+	}
+	select {
+	case <-drained:
+		t.Fatalf("Drained called while a request was in flight")
+	default:
+	}
+
+	unblock <- true
+	if body := <-oldDone; body != "old" {
+		t.Errorf("In flight request didn't finish on the old pipeline: %v", body)
+	}
+	select {
+	case p := <-drained:
+		if p != oldPipe {
+			t.Errorf("Drained called with the wrong pipeline")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Drained wasn't called")
+	}
+}
+
+func TestSetPipelineIdle(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	called := false
+	srv.SetPipeline(NewPipeline(), func(*Pipeline) { called = true })
+	if !called {
+		t.Errorf("Drained should be called right away for an idle pipeline")
+	}
+}
@@ -0,0 +1,168 @@
+package falcore
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// The standard library's middleware signature
+type Middleware func(http.Handler) http.Handler
+
+// Runs net/http middleware as a stage in a Pipeline.  The handler passed to
+// the middleware runs Next, which is usually a Pipeline, and writes its
+// response.  Middleware that wraps the ResponseWriter sees that response,
+// and the request the middleware passes on, such as one with extra
+// context values, replaces HttpRequest.
+//
+// Next may be nil, in which case the stage falls through to the rest of
+// the Upstream list when the middleware calls its handler.  Headers the
+// middleware set before calling it are added to the eventual response
+// unless it sets them itself.  Middleware that responds without calling
+// its handler, like a failed auth check, ends the Upstream list as usual.
+//
+// Next records its own PipelineStageStats.  The middleware's stage comes
+// after them, is named Name and covers the time until the response starts.
+type MiddlewareFilter struct {
+	// Defaults to the name of the Middleware func
+	Name       string
+	Middleware Middleware
+	Next       RequestFilter
+}
+
+func NewMiddlewareFilter(mw Middleware, next RequestFilter) *MiddlewareFilter {
+	return &MiddlewareFilter{Middleware: mw, Next: next}
+}
+
+func (f *MiddlewareFilter) name() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	if fn := runtime.FuncForPC(reflect.ValueOf(f.Middleware).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return reflect.TypeOf(f).String()
+}
+
+func (f *MiddlewareFilter) FilterRequest(req *Request) *http.Response {
+	pss := NewPiplineStage(f.name())
+	pss.Type = PipelineStageTypeUpstream
+	rw := newPopulateResponseWriter(req)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req.HttpRequest = r
+		var res *http.Response
+		if f.Next != nil {
+			res = execFilter(req, f.Next)
+		}
+		if res == nil {
+			rw.fellThrough = true
+			req.addPendingHeader(rw.Header())
+			return
+		}
+		writeResponseHeader(w, res)
+		if res.Body != nil {
+			io.Copy(w, res.Body)
+			res.Body.Close()
+		}
+	})
+
+	// The rest of the stats are recorded on the handler goroutine while
+	// this one waits for the response
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				if rw.sentResponse {
+					// The Request belongs to the Pipeline again
+					Error("%s PANIC in %s: %v\n%s", req.ID, pss.Name, err, debug.Stack())
+					rw.body.closeWrite(fmt.Errorf("panic: %v", err))
+					return
+				}
+				req.CurrentStage = pss
+				rw.fail(req.recoverPanic(err))
+				return
+			}
+			rw.finish()
+		}()
+		f.Middleware(next).ServeHTTP(rw, req.HttpRequest)
+	}()
+
+	res := <-rw.ch
+	pss.EndTime = time.Now()
+	req.appendPipelineStage(pss)
+	return res
+}
+
+// Headers set by a MiddlewareFilter that fell through.  Added to the
+// response when there is one.
+func (fReq *Request) addPendingHeader(h http.Header) {
+	if len(h) == 0 {
+		return
+	}
+	if fReq.pendingHeader == nil {
+		fReq.pendingHeader = make(http.Header)
+	}
+	for k, v := range h {
+		fReq.pendingHeader[k] = v
+	}
+}
+
+func (fReq *Request) applyPendingHeader(res *http.Response) {
+	for k, v := range fReq.pendingHeader {
+		if _, ok := res.Header[k]; !ok {
+			res.Header[k] = v
+		}
+	}
+	fReq.pendingHeader = nil
+}
+
+// Exposes a Pipeline as net/http middleware.  If the Pipeline responds,
+// the response is written and the wrapped handler isn't called.
+// Otherwise the wrapped handler gets the request, including any changes
+// the Pipeline's filters made to HttpRequest, and the time it takes is
+// recorded as a stage named after its type.  The Pipeline's Downstream
+// filters only run on its own responses.
+//
+// CompletionCallback, if set, gets the finished Request as it would from
+// a Server.  res is nil if the wrapped handler responded.
+type PipelineMiddleware struct {
+	Pipeline           *Pipeline
+	CompletionCallback RequestCompletionCallback
+}
+
+func NewPipelineMiddleware(pipeline *Pipeline) *PipelineMiddleware {
+	return &PipelineMiddleware{Pipeline: pipeline}
+}
+
+// Implements Middleware
+func (m *PipelineMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		request := newRequest(r, nil, time.Now())
+		res := m.Pipeline.execute(request)
+		if res != nil {
+			writeResponseHeader(wr, res)
+			request.startPipelineStage("server.ResponseWrite")
+			if res.Body != nil {
+				io.Copy(wr, res.Body)
+				res.Body.Close()
+			}
+			request.finishPipelineStage()
+		} else {
+			request.startPipelineStage(reflect.TypeOf(next).String())
+			request.CurrentStage.Type = PipelineStageTypeUpstream
+			for k, v := range request.pendingHeader {
+				wr.Header()[k] = v
+			}
+			next.ServeHTTP(wr, request.HttpRequest)
+			request.finishPipelineStage()
+		}
+		request.finishRequest()
+		if m.CompletionCallback != nil {
+			go m.CompletionCallback(request, res)
+		}
+	})
+}
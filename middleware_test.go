@@ -0,0 +1,151 @@
+package falcore
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testCtxKey struct{}
+
+func testHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "no auth", 401)
+			return
+		}
+		ctx := context.WithValue(r.Context(), testCtxKey{}, "bob")
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Records the status the rest of the pipeline responds with
+type statusRecorder struct {
+	http.ResponseWriter
+	status *int
+}
+
+func (s statusRecorder) WriteHeader(code int) {
+	*s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func userFilter() RequestFilter {
+	return NewRequestFilter(func(req *Request) *http.Response {
+		user, _ := req.HttpRequest.Context().Value(testCtxKey{}).(string)
+		return StringResponse(req.HttpRequest, 200, nil, "hello "+user)
+	})
+}
+
+func TestMiddlewareFilterFallThrough(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewMiddlewareFilter(testHeaderMiddleware, nil))
+	p.Upstream.PushBack(userFilter())
+
+	req := validGetRequest()
+	req.HttpRequest.Header.Set("Authorization", "yes")
+	res := p.execute(req)
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "hello bob" || res.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Bad response: %q %v", body, res.Header)
+	}
+	if req.PipelineStageStats.Len() != 2 {
+		t.Fatalf("Expected 2 stages, got %v", req.PipelineStageStats.Len())
+	}
+	if pss := req.PipelineStageStats.Front().Value.(*PipelineStageStat); !strings.HasSuffix(pss.Name, "testHeaderMiddleware") {
+		t.Errorf("Bad stage name: %v", pss.Name)
+	}
+
+	// Short circuit
+	req = validGetRequest()
+	res = p.execute(req)
+	body, _ = ioutil.ReadAll(res.Body)
+	if res.StatusCode != 401 || string(body) != "no auth\n" || res.Header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Bad response: %v %q %v", res.StatusCode, body, res.Header)
+	}
+	if req.PipelineStageStats.Len() != 1 {
+		t.Errorf("Expected 1 stage, got %v", req.PipelineStageStats.Len())
+	}
+}
+
+func TestMiddlewareFilterNext(t *testing.T) {
+	status := 0
+	recorder := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(statusRecorder{w, &status}, r)
+		})
+	}
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewMiddlewareFilter(testHeaderMiddleware, nil))
+	inner.Upstream.PushBack(userFilter())
+	f := NewMiddlewareFilter(recorder, inner)
+	f.Name = "recorder"
+	p := NewPipeline()
+	p.Upstream.PushBack(f)
+
+	req := validGetRequest()
+	req.HttpRequest.Header.Set("Authorization", "yes")
+	res := p.execute(req)
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "hello bob" || status != 200 {
+		t.Errorf("Bad response: %q %v", body, status)
+	}
+	var names []string
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		names = append(names, e.Value.(*PipelineStageStat).Name)
+	}
+	if len(names) != 3 || names[1] != "*falcore.genericRequestFilter" || names[2] != "recorder" {
+		t.Errorf("Bad stages: %v", names)
+	}
+}
+
+func TestMiddlewareFilterPanic(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewMiddlewareFilter(func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("middleware") })
+	}, nil))
+	req := validGetRequest()
+	if res := p.execute(req); res == nil || res.StatusCode != 500 {
+		t.Fatalf("Expected 500, got %v", res)
+	}
+	if pss := req.PipelineStageStats.Back().Value.(*PipelineStageStat); pss.Status != 2 {
+		t.Errorf("Expected failed stage, got %v", pss.Status)
+	}
+}
+
+func TestPipelineMiddleware(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewMiddlewareFilter(testHeaderMiddleware, nil))
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/falcore" {
+			return StringResponse(req.HttpRequest, 200, nil, "from falcore")
+		}
+		return nil
+	}))
+	done := make(chan *Request, 1)
+	m := NewPipelineMiddleware(p)
+	m.CompletionCallback = func(req *Request, res *http.Response) { done <- req }
+	handler := m.Wrap(http.HandlerFunc(userFilterHandler))
+
+	for path, expected := range map[string]string{"/falcore": "from falcore", "/mux": "hello bob"} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "yes")
+		handler.ServeHTTP(rec, r)
+		if rec.Body.String() != expected || rec.Header().Get("X-Frame-Options") != "DENY" {
+			t.Errorf("%v: bad response %q %v", path, rec.Body.String(), rec.Header())
+		}
+		if req := <-done; req.PipelineStageStats.Len() != 3 {
+			t.Errorf("%v: expected 3 stages, got %v", path, req.PipelineStageStats.Len())
+		}
+	}
+}
+
+func userFilterHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value(testCtxKey{}).(string)
+	w.Write([]byte("hello " + user))
+}
@@ -2,14 +2,19 @@ package falcore
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestFilterPanic(t *testing.T) {
 	pipeline := NewPipeline()
 	pipeline.Upstream.PushBack(NewRequestFilter(func(*Request) *http.Response { panic("this isn't supposed to happen") }))
+	pipeline.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Downstream", "yes")
+	}))
 	srv := NewServer(0, pipeline)
 	defer srv.StopAccepting()
 	go func() {
@@ -17,14 +22,88 @@ func TestFilterPanic(t *testing.T) {
 	}()
 	<-srv.AcceptReady
 
-	var caught bool
-	srv.PanicHandler = func(c net.Conn, err interface{}) {
-		if c != nil && err != nil {
-			caught = true
+	completed := make(chan *Request, 1)
+	srv.CompletionCallback = func(req *Request, res *http.Response) {
+		completed <- req
+	}
+	res, err := http.Get(fmt.Sprintf("http://localhost:%d", srv.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 500 {
+		t.Errorf("Expected 500, got %v", res.StatusCode)
+	}
+	if res.Header.Get("X-Downstream") != "yes" {
+		t.Errorf("Downstream filters didn't run")
+	}
+	select {
+	case req := <-completed:
+		// server.Init, the filter, the downstream filter, server.ResponseWrite
+		e := req.PipelineStageStats.Front().Next()
+		if pss := e.Value.(*PipelineStageStat); pss.Status != 2 {
+			t.Errorf("Panicking stage should have failed status, got %v", pss.Status)
 		}
+	case <-time.After(time.Second):
+		t.Errorf("Completion callback wasn't called")
+	}
+}
+
+func TestPipelinePanicResponse(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRouter(func(*Request) RequestFilter { panic("router panic") }))
+	outer := NewPipeline()
+	outer.PanicResponse = func(req *Request, err interface{}) *http.Response {
+		return StringResponse(req.HttpRequest, 503, nil, fmt.Sprint(err))
 	}
+	outer.Upstream.PushBack(inner)
+	outer.Downstream.PushBack(NewResponseFilter(func(*Request, *http.Response) { panic("downstream panic") }))
+
+	req := validGetRequest()
+	res := outer.execute(req)
+	if res.StatusCode != 503 {
+		t.Errorf("Expected 503, got %v", res.StatusCode)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "downstream panic" {
+		t.Errorf("Downstream panic should replace the response, got %q", body)
+	}
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		if pss := e.Value.(*PipelineStageStat); pss.Status != 2 {
+			t.Errorf("Stage %v should have failed", pss.Name)
+		}
+	}
+}
+
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) {
+	panic("body panic")
+}
+
+func TestServerPanicHandler(t *testing.T) {
+	// A panic while writing the response can't be recovered by the pipeline
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, -1, panicReader{})
+	}))
+	srv := NewServer(0, pipeline)
+	defer srv.StopAccepting()
+	caught := make(chan bool, 1)
+	srv.PanicHandler = func(c net.Conn, err interface{}) {
+		caught <- c != nil && err != nil
+	}
+	go func() {
+		srv.ListenAndServe()
+	}()
+	<-srv.AcceptReady
+
 	http.Get(fmt.Sprintf("http://localhost:%d", srv.Port()))
-	if !caught {
+	select {
+	case ok := <-caught:
+		if !ok {
+			t.Errorf("Panic handler got bad arguments")
+		}
+	case <-time.After(time.Second):
 		t.Fatal("panic handler was not called")
 	}
 }
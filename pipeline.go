@@ -2,8 +2,10 @@ package falcore
 
 import (
 	"container/list"
+	"fmt"
 	"net/http"
 	"reflect"
+	"runtime/debug"
 )
 
 // Pipelines have an Upstream and Downstream list of filters.
@@ -14,19 +16,54 @@ import (
 // in the Downstream list, in order.
 //
 // If no Response is returned from any of the Upstream filters,
-// then execution of the Downstream is skipped and the server
-// will return a default 404 response.
+// a nested Pipeline skips its Downstream and returns nil so the
+// enclosing Pipeline carries on.  The Server's Pipeline runs its
+// Downstream on the default 404 response instead.
 //
 // The Upstream list may also contain instances of Router.
+//
+// The Downstream list may contain ResponseFilters, ResponseFilterEs and
+// ResponseReplacers.  A ResponseReplacer can return a new response for
+// the rest of the list.
+//
+// Finally is a list of the same kinds of filters that runs last, after
+// Downstream, once the Pipeline has a response.  It's deferred, so it still
+// runs when a filter panicked or returned an error, or the request ran out
+// of time.
+//
+// Filters may implement RequestFilterE or ResponseFilterE instead to
+// return errors.  Errors are logged, the stage is marked failed (Status 2)
+// and the response comes from ErrorRenderer.
+//
+// A panic in any filter or Router is recovered.  The stage is marked
+// failed (Status 2), the stack is logged along with the Request.ID and
+// the response is replaced with one from PanicResponse.  The Downstream
+// filters still run.  Nested Pipelines inherit PanicResponse from the
+// Pipeline that contains them unless they set their own.
 type Pipeline struct {
 	Upstream   *list.List
 	Downstream *list.List
+	Finally    *list.List
+	// Generates the response after a panic.  DefaultPanicResponse is used if
+	// this is nil and no enclosing Pipeline has one either.
+	PanicResponse func(req *Request, err interface{}) *http.Response
+	// Generates the response for errors returned by filters.
+	// DefaultErrorRenderer is used if this is nil and no enclosing
+	// Pipeline has one either.
+	ErrorRenderer ErrorRenderer
+}
+
+// Renders a 500 error with RenderError.  Used for panics if there is no
+// Pipeline.PanicResponse.
+func DefaultPanicResponse(req *Request, err interface{}) *http.Response {
+	return RenderError(req, NewHTTPError(500, "", fmt.Errorf("panic: %v", err)))
 }
 
 func NewPipeline() (l *Pipeline) {
 	l = new(Pipeline)
 	l.Upstream = list.New()
 	l.Downstream = list.New()
+	l.Finally = list.New()
 	return
 }
 
@@ -35,23 +72,55 @@ func (p *Pipeline) FilterRequest(req *Request) *http.Response {
 	return p.execute(req)
 }
 
-func (p *Pipeline) execute(req *Request) (res *http.Response) {
+func (p *Pipeline) execute(req *Request) *http.Response {
+	return p.run(req, false)
+}
+
+// Runs the Pipeline for the Server.  Unlike execute, it always returns
+// a response.
+func (p *Pipeline) serve(req *Request) *http.Response {
+	return p.run(req, true)
+}
+
+func (p *Pipeline) run(req *Request, top bool) (res *http.Response) {
+	if p.PanicResponse != nil {
+		prev := req.panicResponse
+		req.panicResponse = p.PanicResponse
+		defer func() { req.panicResponse = prev }()
+	}
+	if p.ErrorRenderer != nil {
+		prev := req.errorRenderer
+		req.errorRenderer = p.ErrorRenderer
+		defer func() { req.errorRenderer = prev }()
+	}
+	if p.Finally != nil && p.Finally.Len() > 0 {
+		defer func() {
+			if res != nil {
+				res = p.downList(req, p.Finally, res)
+			}
+		}()
+	}
+
 	for e := p.Upstream.Front(); e != nil && res == nil; e = e.Next() {
+		// Stop if the request's deadline has passed
+		if err := req.HttpRequest.Context().Err(); err != nil {
+			res = req.deadlineExceeded(err)
+			break
+		}
 		switch filter := e.Value.(type) {
 		case Router:
-			t := reflect.TypeOf(filter)
-			req.startPipelineStage(t.String())
-			req.CurrentStage.Type = PipelineStageTypeRouter
-			pipe := filter.SelectPipeline(req)
-			req.finishPipelineStage()
+			var pipe RequestFilter
+			if pipe, res = p.execRouter(req, filter); res != nil {
+				break
+			}
 			if pipe != nil {
-				res = p.execFilter(req, pipe)
+				res = execFilter(req, pipe)
 				if res != nil {
 					break
 				}
 			}
-		case RequestFilter:
-			res = p.execFilter(req, filter)
+		case RequestFilter, RequestFilterE:
+			res = execFilter(req, filter)
 			if res != nil {
 				break
 			}
@@ -61,34 +130,132 @@ func (p *Pipeline) execute(req *Request) (res *http.Response) {
 		}
 	}
 
+	if res == nil && top {
+		res = StringResponse(req.HttpRequest, 404, nil, "Not Found")
+	}
+	if res != nil && req.pendingHeader != nil {
+		req.applyPendingHeader(res)
+	}
 	if res != nil {
-		p.down(req, res)
+		res = p.downList(req, p.Downstream, res)
 	}
 
 	return
 }
 
-func (p *Pipeline) execFilter(req *Request, filter RequestFilter) *http.Response {
-	if _, skipTracking := filter.(*Pipeline); !skipTracking {
+// Returns the selected filter, or a response if the Router panicked
+func (p *Pipeline) execRouter(req *Request, router Router) (pipe RequestFilter, res *http.Response) {
+	t := reflect.TypeOf(router)
+	req.startPipelineStage(t.String())
+	req.CurrentStage.Type = PipelineStageTypeRouter
+	defer req.finishPipelineStage()
+	defer func() {
+		if err := recover(); err != nil {
+			pipe, res = nil, req.recoverPanic(err)
+		}
+	}()
+	return router.SelectPipeline(req), nil
+}
+
+// filter must be a RequestFilter or RequestFilterE.  Pipelines,
+// TimeoutFilters, FanOutFilters and MiddlewareFilters record stats for
+// their own stages so they aren't tracked.
+func execFilter(req *Request, filter interface{}) (res *http.Response) {
+	switch filter.(type) {
+	case *Pipeline, *TimeoutFilter, *FanOutFilter, *MiddlewareFilter:
+	default:
 		t := reflect.TypeOf(filter)
 		req.startPipelineStage(t.String())
 		req.CurrentStage.Type = PipelineStageTypeUpstream
 		defer req.finishPipelineStage()
 	}
-	return filter.FilterRequest(req)
+	defer func() {
+		if err := recover(); err != nil {
+			res = req.recoverPanic(err)
+		}
+	}()
+	if fe, ok := filter.(RequestFilterE); ok {
+		var err error
+		if res, err = fe.FilterRequestE(req); err != nil {
+			res = req.filterError(err)
+		}
+		return
+	}
+	return filter.(RequestFilter).FilterRequest(req)
 }
 
-func (p *Pipeline) down(req *Request, res *http.Response) {
-	for e := p.Downstream.Front(); e != nil; e = e.Next() {
-		if filter, ok := e.Value.(ResponseFilter); ok {
-			t := reflect.TypeOf(filter)
-			req.startPipelineStage(t.String())
-			req.CurrentStage.Type = PipelineStageTypeDownstream
-			filter.FilterResponse(req, res)
-			req.finishPipelineStage()
-		} else {
-			// TODO
-			break
+// Runs the filters in l on res and returns the final response
+func (p *Pipeline) downList(req *Request, l *list.List, res *http.Response) *http.Response {
+	for e := l.Front(); e != nil; e = e.Next() {
+		switch e.Value.(type) {
+		case ResponseFilter, ResponseFilterE, ResponseReplacer:
+			res = p.execResponseFilter(req, e.Value, res)
+		default:
+			Error("%v (%T) is not a ResponseFilter\n", e.Value, e.Value)
+		}
+	}
+	return res
+}
+
+// filter must be a ResponseFilter, ResponseFilterE or ResponseReplacer.
+// Returns the response to continue with.  A panic or error replaces res
+// with the error response.
+func (p *Pipeline) execResponseFilter(req *Request, filter interface{}, res *http.Response) (out *http.Response) {
+	t := reflect.TypeOf(filter)
+	req.startPipelineStage(t.String())
+	req.CurrentStage.Type = PipelineStageTypeDownstream
+	defer req.finishPipelineStage()
+	out = res
+	defer func() {
+		if err := recover(); err != nil {
+			out = replaceResponse(res, req.recoverPanic(err))
+		}
+	}()
+	switch f := filter.(type) {
+	case ResponseReplacer:
+		if with := f.ReplaceResponse(req, res); with != nil {
+			out = replaceResponse(res, with)
+		}
+	case ResponseFilterE:
+		if err := f.FilterResponseE(req, res); err != nil {
+			out = replaceResponse(res, req.filterError(err))
 		}
+	default:
+		filter.(ResponseFilter).FilterResponse(req, res)
+	}
+	return
+}
+
+// Returns with, closing the body of res unless with still uses it
+func replaceResponse(res *http.Response, with *http.Response) *http.Response {
+	if res.Body != nil && res.Body != with.Body {
+		res.Body.Close()
+	}
+	return with
+}
+
+// Logs a recovered panic, marks the CurrentStage failed and
+// generates the error response
+func (req *Request) recoverPanic(err interface{}) *http.Response {
+	Error("%s PANIC in %s: %v\n%s", req.ID, req.CurrentStage.Name, err, debug.Stack())
+	req.CurrentStage.Status = 2 // Fail
+	gen := req.panicResponse
+	if gen == nil {
+		gen = DefaultPanicResponse
+	}
+	return gen(req, err)
+}
+
+// Logs an error returned by a filter, marks the CurrentStage failed
+// (unless the filter set its own status) and renders the error response
+func (req *Request) filterError(err error) *http.Response {
+	if he := AsHTTPError(err); he.StatusCode >= 500 {
+		Error("%s Error in %s: %v", req.ID, req.CurrentStage.Name, err)
+	} else {
+		Debug("%s Error in %s: %v", req.ID, req.CurrentStage.Name, err)
+	}
+	if req.CurrentStage.Status == 0 {
+		req.CurrentStage.Status = 2 // Fail
 	}
+	return RenderError(req, err)
 }
@@ -3,7 +3,10 @@ package falcore
 import (
 	"bytes"
 	"container/list"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -174,3 +177,67 @@ func TestPipelineStatsChecksum(t *testing.T) {
 	//req.Trace()
 
 }
+
+func TestResponseReplacer(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 500, nil, "internal details")
+	}))
+	p.Downstream.PushBack(NewResponseReplacer(func(req *Request, res *http.Response) *http.Response {
+		if res.StatusCode >= 500 {
+			return StringResponse(req.HttpRequest, 503, nil, "try later")
+		}
+		return nil
+	}))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Seen", strconv.Itoa(res.StatusCode))
+	}))
+	res := p.execute(validGetRequest())
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 503 || string(body) != "try later" || res.Header.Get("X-Seen") != "503" {
+		t.Errorf("Bad response: %v %q %v", res.StatusCode, body, res.Header)
+	}
+}
+
+func TestServerNotFoundDownstream(t *testing.T) {
+	p := NewPipeline()
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-Downstream", "yes")
+	}))
+	srv := NewServer(0, p)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 404 || rec.Header().Get("X-Downstream") != "yes" {
+		t.Errorf("Downstream didn't run on 404: %v %v", rec.Code, rec.Header())
+	}
+
+	// Nested pipelines still fall through
+	req := validGetRequest()
+	if res := p.execute(req); res != nil {
+		t.Errorf("Expected nil response, got %v", res.StatusCode)
+	}
+}
+
+func TestPipelineFinally(t *testing.T) {
+	ran := 0
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		panic("upstream")
+	}))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		panic("downstream")
+	}))
+	p.Finally.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		ran = res.StatusCode
+	}))
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 500 {
+		t.Errorf("Expected 500, got %v", res.StatusCode)
+	}
+	if ran != 500 {
+		t.Errorf("Finally didn't run: %v", ran)
+	}
+	if pss := req.PipelineStageStats.Back().Value.(*PipelineStageStat); pss.Type != PipelineStageTypeDownstream || pss.Status != 0 {
+		t.Errorf("Bad finally stage: %+v", pss)
+	}
+}
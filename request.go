@@ -1,7 +1,9 @@
 package falcore
 
 import (
+	"bufio"
 	"container/list"
+	"crypto/tls"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -22,6 +24,7 @@ import (
 // Context is provided to allow for passing data between stages.
 // For example, you may have an authentication filter that sets
 // the auth information in Context for use at a later stage.
+// Key provides a typed, goroutine safe alternative.
 //
 // There is a unique ID assigned to each request.  This ID is not
 // globally unique to keep it shorter for logging purposes.  It is
@@ -39,7 +42,6 @@ import (
 // like pipeline iteration and the stat collection itself.
 //
 // See falcore.PipelineStageStat docs for more info.
-//
 type Request struct {
 	ID                 string
 	StartTime          time.Time
@@ -53,17 +55,34 @@ type Request struct {
 	Context            map[string]interface{}
 	pipelineHash       hash.Hash32
 	piplineTot         time.Duration
+	panicResponse      func(req *Request, err interface{}) *http.Response
+	errorRenderer      ErrorRenderer
+	values             *requestValues
+	pendingHeader      http.Header
+	// Set by the Server for ServeHandler
+	hijacker        func() (net.Conn, *bufio.ReadWriter, error)
+	hijacked        bool
+	responseFlusher func() error
 }
 
 // Used internally to create and initialize a new request.
 func newRequest(request *http.Request, conn net.Conn, startTime time.Time) *Request {
 	fReq := new(Request)
 	fReq.Context = make(map[string]interface{})
+	fReq.values = new(requestValues)
 	fReq.HttpRequest = request
 	fReq.StartTime = startTime
 	fReq.connection = conn
 	if conn != nil {
 		fReq.RemoteAddr = conn.RemoteAddr().(*net.TCPAddr)
+		// http.ReadRequest doesn't know about the connection
+		if request.RemoteAddr == "" {
+			request.RemoteAddr = fReq.RemoteAddr.String()
+		}
+		if tc, ok := conn.(*tls.Conn); ok && request.TLS == nil {
+			state := tc.ConnectionState()
+			request.TLS = &state
+		}
 	}
 
 	// create a semi-unique id to track a connection in the logs
@@ -88,12 +107,16 @@ func newRequest(request *http.Request, conn net.Conn, startTime time.Time) *Requ
 // Returns a completed falcore.Request and response after running the single filter stage
 // The PipelineStageStats is completed in the returned Request
 // The falcore.Request.Connection and falcore.Request.RemoteAddr are nil
-func TestWithRequest(request *http.Request, filter RequestFilter, context map[string]interface{}) (*Request, *http.Response) {
+// Typed values, created with Key.Value, are set before the filter runs
+func TestWithRequest(request *http.Request, filter RequestFilter, context map[string]interface{}, values ...KeyValue) (*Request, *http.Response) {
 	r := newRequest(request, nil, time.Now())
 	if context == nil {
 		context = make(map[string]interface{})
 	}
 	r.Context = context
+	for _, kv := range values {
+		kv.apply(r)
+	}
 	t := reflect.TypeOf(filter)
 	r.startPipelineStage(t.String())
 	r.CurrentStage.Type = PipelineStageTypeUpstream
@@ -103,6 +126,22 @@ func TestWithRequest(request *http.Request, filter RequestFilter, context map[st
 	return r, res
 }
 
+// Returns a completed falcore.Request and response after running pipeline
+// the same way the Server does, including Routers, Downstream and Finally
+// filters, the default 404 and the Server's response fixups.
+// conn may be nil.  Otherwise it's used as the Request's connection and its
+// RemoteAddr must be a *net.TCPAddr.  See the falcoretest package for
+// helpers built on this.
+func TestWithPipeline(request *http.Request, pipeline *Pipeline, conn net.Conn, values ...KeyValue) (*Request, *http.Response) {
+	r := newRequest(request, conn, time.Now())
+	for _, kv := range values {
+		kv.apply(r)
+	}
+	res := new(Server).handlerExecutePipeline(pipeline, r, true)
+	r.finishRequest()
+	return r, res
+}
+
 // Starts a new pipeline stage and makes it the CurrentStage.
 func (fReq *Request) startPipelineStage(name string) {
 	fReq.CurrentStage = NewPiplineStage(name)
@@ -123,6 +162,14 @@ func (fReq *Request) appendPipelineStage(pss *PipelineStageStat) {
 	fReq.finishCommon()
 }
 
+// Adds a finished stage for work done inside the CurrentStage, such as
+// each attempt made by a filter that retries.  CurrentStage is unchanged.
+func (fReq *Request) RecordPipelineStage(pss *PipelineStageStat) {
+	cur := fReq.CurrentStage
+	fReq.appendPipelineStage(pss)
+	fReq.CurrentStage = cur
+}
+
 // Does some required bookeeping for the pipeline and the pipeline signature
 func (fReq *Request) finishCommon() {
 	fReq.pipelineHash.Write([]byte(fReq.CurrentStage.Name))
@@ -169,13 +216,13 @@ func (fReq *Request) finishRequest() {
 // For the Status, the falcore library will not apply any specific meaning to the status
 // codes but the following are suggested conventional usages that we have found useful
 //
-//   type PipelineStatus byte
-//   const (
-// 	    Success PipelineStatus = iota   // General Run successfully
-//	    Skip                            // Skipped (all or most of the work of this stage)
-//	    Fail                            // General Fail
-//	    // All others may be used as custom status codes
-//   )
+//	  type PipelineStatus byte
+//	  const (
+//		    Success PipelineStatus = iota   // General Run successfully
+//		    Skip                            // Skipped (all or most of the work of this stage)
+//		    Fail                            // General Fail
+//		    // All others may be used as custom status codes
+//	  )
 type PipelineStageStat struct {
 	Name      string
 	Type      PipelineStageType
@@ -0,0 +1,216 @@
+package router
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/fitstar/falcore"
+)
+
+// Interface for routes that need more than the URL path to decide.
+// PathRouter will call MatchRequest instead of MatchString for routes
+// that implement this interface.
+type RequestRoute interface {
+	// Returns the route's filter if there's a match.  nil if there isn't
+	MatchRequest(req *falcore.Request) falcore.RequestFilter
+}
+
+// A condition on the request.  Predicates can be combined with And, Or
+// and Not to build up more complex conditions.
+type Predicate interface {
+	Match(req *falcore.Request) bool
+}
+
+// Generate a Predicate from a func
+type PredicateFunc func(req *falcore.Request) bool
+
+func (f PredicateFunc) Match(req *falcore.Request) bool {
+	return f(req)
+}
+
+// Will match if Predicate matches the request
+type PredicateRoute struct {
+	Predicate Predicate
+	Filter    falcore.RequestFilter
+}
+
+func (r *PredicateRoute) MatchRequest(req *falcore.Request) falcore.RequestFilter {
+	if r.Predicate.Match(req) {
+		return r.Filter
+	}
+	return nil
+}
+
+// Matches if all of the predicates match.  Matches if there are none.
+func And(preds ...Predicate) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		for _, p := range preds {
+			if !p.Match(req) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Matches if any of the predicates match.  Doesn't match if there are none.
+func Or(preds ...Predicate) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		for _, p := range preds {
+			if p.Match(req) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Matches if pred doesn't
+func Not(pred Predicate) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return !pred.Match(req)
+	})
+}
+
+// Matches if the request method is one of methods
+func Method(methods ...string) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		for _, m := range methods {
+			if req.HttpRequest.Method == m {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Matches if the named header equals value.  If value is empty,
+// matches if the header is present at all.
+func Header(name, value string) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return matchValues(req.HttpRequest.Header[http.CanonicalHeaderKey(name)], value)
+	})
+}
+
+// Matches if any value of the named header matches re
+func HeaderRegexp(name string, re *regexp.Regexp) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return matchValuesRegexp(req.HttpRequest.Header[http.CanonicalHeaderKey(name)], re)
+	})
+}
+
+// Matches if the named query parameter equals value.  If value is empty,
+// matches if the parameter is present at all.
+func Query(name, value string) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return matchValues(req.HttpRequest.URL.Query()[name], value)
+	})
+}
+
+// Matches if any value of the named query parameter matches re
+func QueryRegexp(name string, re *regexp.Regexp) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return matchValuesRegexp(req.HttpRequest.URL.Query()[name], re)
+	})
+}
+
+// Matches if the named cookie equals value.  If value is empty,
+// matches if the cookie is present at all.
+func Cookie(name, value string) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		c, err := req.HttpRequest.Cookie(name)
+		return err == nil && (value == "" || c.Value == value)
+	})
+}
+
+// Matches if the named cookie is present and its value matches re
+func CookieRegexp(name string, re *regexp.Regexp) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		c, err := req.HttpRequest.Cookie(name)
+		return err == nil && re.MatchString(c.Value)
+	})
+}
+
+// Matches if the URL path starts with prefix
+func PathPrefix(prefix string) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return strings.HasPrefix(req.HttpRequest.URL.Path, prefix)
+	})
+}
+
+// Matches if the URL path matches re
+func PathRegexp(re *regexp.Regexp) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return re.MatchString(req.HttpRequest.URL.Path)
+	})
+}
+
+// Matches if the request host, without the port, is one of hosts.
+// Comparison is case insensitive.
+func Host(hosts ...string) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		host := requestHost(req)
+		for _, h := range hosts {
+			if strings.EqualFold(host, h) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Matches if the request host, without the port, matches re
+func HostRegexp(re *regexp.Regexp) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		return re.MatchString(requestHost(req))
+	})
+}
+
+// Matches if the media type of the request's Content-Type is one of types.
+// Parameters such as charset are ignored.
+func ContentType(types ...string) Predicate {
+	return PredicateFunc(func(req *falcore.Request) bool {
+		mt, _, err := mime.ParseMediaType(req.HttpRequest.Header.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		for _, t := range types {
+			if strings.EqualFold(mt, t) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func requestHost(req *falcore.Request) string {
+	host := req.HttpRequest.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+func matchValues(values []string, value string) bool {
+	if value == "" {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchValuesRegexp(values []string, re *regexp.Regexp) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestPredicates(t *testing.T) {
+	req := validGetRequest()
+	req.HttpRequest.Host = "api.example.com:8080"
+	req.HttpRequest.Header.Set("X-Api-Version", "2")
+	req.HttpRequest.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.HttpRequest.URL.RawQuery = "format=xml&debug"
+	req.HttpRequest.AddCookie(&http.Cookie{Name: "beta", Value: "yes"})
+
+	tests := []struct {
+		name  string
+		pred  Predicate
+		match bool
+	}{
+		{"method", Method("POST", "GET"), true},
+		{"method miss", Method("POST"), false},
+		{"header", Header("x-api-version", "2"), true},
+		{"header present", Header("X-Api-Version", ""), true},
+		{"header miss", Header("X-Api-Version", "3"), false},
+		{"header regexp", HeaderRegexp("X-Api-Version", regexp.MustCompile(`^[12]$`)), true},
+		{"query", Query("format", "xml"), true},
+		{"query present", Query("debug", ""), true},
+		{"query miss", Query("nope", ""), false},
+		{"cookie", Cookie("beta", "yes"), true},
+		{"cookie miss", Cookie("alpha", ""), false},
+		{"path prefix", PathPrefix("/hel"), true},
+		{"path regexp", PathRegexp(regexp.MustCompile(`^/bye`)), false},
+		{"host", Host("API.example.com"), true},
+		{"host regexp", HostRegexp(regexp.MustCompile(`^www\.`)), false},
+		{"content type", ContentType("application/json"), true},
+		{"and", And(Method("GET"), Header("X-Api-Version", "2")), true},
+		{"and miss", And(Method("GET"), Header("X-Api-Version", "3")), false},
+		{"or", Or(Method("PUT"), Query("format", "xml")), true},
+		{"or empty", Or(), false},
+		{"not", Not(Method("GET")), false},
+	}
+	for _, test := range tests {
+		if m := test.pred.Match(req); m != test.match {
+			t.Errorf("%v: got %v expected %v", test.name, m, test.match)
+		}
+	}
+}
+
+func TestPathRouterMixedRoutes(t *testing.T) {
+	var sf1 SimpleFilter = 1
+	var sf2 SimpleFilter = 2
+	var sf3 SimpleFilter = 3
+
+	pr := NewPathRouter()
+	pr.AddPredicate(And(PathPrefix("/hello"), Header("X-Api-Version", "2")), sf1)
+	pr.AddMatch(`^/hello`, sf2)
+	pr.AddRoute(&MatchAnyRoute{sf3})
+
+	req := validGetRequest()
+	if f := pr.SelectPipeline(req); f != sf2 {
+		t.Errorf("Expected regexp route, got %v", f)
+	}
+	req.HttpRequest.Header.Set("X-Api-Version", "2")
+	if f := pr.SelectPipeline(req); f != sf1 {
+		t.Errorf("Expected predicate route, got %v", f)
+	}
+	req.HttpRequest.URL.Path = "/other"
+	if f := pr.SelectPipeline(req); f != sf3 {
+		t.Errorf("Expected fallthrough route, got %v", f)
+	}
+}
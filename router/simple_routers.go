@@ -2,8 +2,10 @@ package router
 
 import (
 	"container/list"
+	"fmt"
 	"github.com/fitstar/falcore"
 	"regexp"
+	"sort"
 )
 
 // Interface for defining individual routes
@@ -55,7 +57,22 @@ func (r *HostRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestF
 	return r.hosts[req.HttpRequest.Host]
 }
 
-// Route requests based on path
+// Implements falcore.PipelineBrancher.  Branches are sorted by host.
+func (r *HostRouter) PipelineBranches() []falcore.PipelineBranch {
+	hosts := make([]string, 0, len(r.hosts))
+	for host := range r.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	branches := make([]falcore.PipelineBranch, len(hosts))
+	for i, host := range hosts {
+		branches[i] = falcore.PipelineBranch{Label: host, Filter: r.hosts[host]}
+	}
+	return branches
+}
+
+// Route requests based on path.  Routes are tried in order and
+// may be any mix of Route and RequestRoute.
 type PathRouter struct {
 	Routes *list.List
 }
@@ -71,6 +88,16 @@ func (r *PathRouter) AddRoute(route Route) {
 	r.Routes.PushBack(route)
 }
 
+// Add a route that can look at the whole request
+func (r *PathRouter) AddRequestRoute(route RequestRoute) {
+	r.Routes.PushBack(route)
+}
+
+// convenience method for adding PredicateRoutes
+func (r *PathRouter) AddPredicate(pred Predicate, filter falcore.RequestFilter) {
+	r.Routes.PushBack(&PredicateRoute{Predicate: pred, Filter: filter})
+}
+
 // convenience method for adding RegexpRoutes
 func (r *PathRouter) AddMatch(match string, filter falcore.RequestFilter) (err error) {
 	route := &RegexpRoute{Filter: filter}
@@ -80,14 +107,37 @@ func (r *PathRouter) AddMatch(match string, filter falcore.RequestFilter) (err e
 	return
 }
 
-// Will panic if r.Routes contains an object that isn't a Route
+// Will panic if r.Routes contains an object that isn't a Route or RequestRoute
 func (r *PathRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestFilter) {
-	var route Route
 	for r := r.Routes.Front(); r != nil; r = r.Next() {
-		route = r.Value.(Route)
-		if f := route.MatchString(req.HttpRequest.URL.Path); f != nil {
+		if route, ok := r.Value.(RequestRoute); ok {
+			if f := route.MatchRequest(req); f != nil {
+				return f
+			}
+		} else if f := r.Value.(Route).MatchString(req.HttpRequest.URL.Path); f != nil {
 			return f
 		}
 	}
 	return nil
 }
+
+// Implements falcore.PipelineBrancher.  Branches are in route order.
+// Routes of unknown types are labeled with their type and have no filter.
+func (r *PathRouter) PipelineBranches() []falcore.PipelineBranch {
+	var branches []falcore.PipelineBranch
+	for e := r.Routes.Front(); e != nil; e = e.Next() {
+		var b falcore.PipelineBranch
+		switch route := e.Value.(type) {
+		case *RegexpRoute:
+			b = falcore.PipelineBranch{Label: route.Match.String(), Filter: route.Filter}
+		case *MatchAnyRoute:
+			b = falcore.PipelineBranch{Label: "*", Filter: route.Filter}
+		case *PredicateRoute:
+			b = falcore.PipelineBranch{Label: "predicate", Filter: route.Filter}
+		default:
+			b = falcore.PipelineBranch{Label: fmt.Sprintf("%T", route)}
+		}
+		branches = append(branches, b)
+	}
+	return branches
+}
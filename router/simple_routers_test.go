@@ -59,3 +59,32 @@ func TestHostRouter(t *testing.T) {
 		t.Errorf("Host router got currently unsupported fuzzy match so you should update this test")
 	}
 }
+
+func TestRouterBranches(t *testing.T) {
+	var sf1 SimpleFilter = 1
+	var sf2 SimpleFilter = 2
+
+	pr := NewPathRouter()
+	pr.AddMatch(`^/one`, sf1)
+	pr.AddRoute(&MatchAnyRoute{sf2})
+	sub := falcore.NewPipeline()
+	sub.Upstream.PushBack(pr)
+	hr := NewHostRouter()
+	hr.AddMatch("www.ngmoco.com", sub)
+
+	p := falcore.NewPipeline()
+	p.Upstream.PushBack(hr)
+	node := falcore.InspectPipeline(p)
+
+	host := node.Upstream[0]
+	if len(host.Branches) != 1 || host.Branches[0].Label != "www.ngmoco.com" {
+		t.Fatalf("Bad host router branches: %+v", host.Branches)
+	}
+	path := host.Branches[0].Node.Upstream[0]
+	if path.Kind != falcore.PipelineNodeRouter || len(path.Branches) != 2 {
+		t.Fatalf("Bad path router node: %+v", path)
+	}
+	if path.Branches[0].Label != "^/one" || path.Branches[1].Label != "*" {
+		t.Errorf("Bad path router labels: %v %v", path.Branches[0].Label, path.Branches[1].Label)
+	}
+}
@@ -0,0 +1,216 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fitstar/falcore"
+)
+
+// Resolution of SplitRouter percentages.  100% is splitBuckets buckets.
+const splitBuckets = 10000
+
+// The most branches a SplitRouter can have.  Each needs its own
+// CurrentStage.Status.
+const maxSplitBranches = 255
+
+// Returns the key used to make sticky assignments in a SplitRouter.
+// Requests with the same key will always be sent to the same branch
+// as long as the percentages don't change.  An empty key means the request
+// is assigned randomly.
+type SplitKeyFunc func(req *falcore.Request) string
+
+// Use the value of the named cookie as the sticky key
+func CookieSplitKey(name string) SplitKeyFunc {
+	return func(req *falcore.Request) string {
+		if c, err := req.HttpRequest.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+}
+
+// Use the value of the named header as the sticky key
+func HeaderSplitKey(name string) SplitKeyFunc {
+	return func(req *falcore.Request) string {
+		return req.HttpRequest.Header.Get(name)
+	}
+}
+
+// Use the client's IP address as the sticky key
+func ClientIPSplitKey() SplitKeyFunc {
+	return func(req *falcore.Request) string {
+		if req.RemoteAddr != nil {
+			return req.RemoteAddr.IP.String()
+		}
+		// No connection (ServeHTTP or testing)
+		if host, _, err := net.SplitHostPort(req.HttpRequest.RemoteAddr); err == nil {
+			return host
+		}
+		return req.HttpRequest.RemoteAddr
+	}
+}
+
+// An alternative destination for a share of the traffic in a SplitRouter
+type SplitBranch struct {
+	Name    string
+	Filter  falcore.RequestFilter
+	Percent float64
+}
+
+// The immutable routing table.  It is replaced as a whole when
+// percentages change so SelectPipeline never has to lock.
+type splitTable struct {
+	branches []*SplitBranch
+	// upper bucket bound (exclusive) of each branch
+	bounds []int
+}
+
+// Splits traffic by percentage between a Default filter and any number
+// of alternative branches.  Useful for canary releases and A/B testing.
+//
+// Each request is hashed into a bucket using KeyFunc, if it's set, or at
+// random otherwise.  The branches own the lowest buckets in the order they
+// were added and Default gets whatever is left over.  Each branch's buckets
+// start where the previous branch's end, so changing a branch's percentage
+// shifts the buckets of every branch after it.  Only with a single branch,
+// or when changing the last one, do sticky clients move just between
+// Default and that branch.
+//
+// There can be at most 255 branches.
+//
+// The chosen branch is recorded in the router's CurrentStage.Status so it
+// is part of the Request.Signature().  Default is 0 and each branch is
+// numbered from 1 in the order it was added.
+type SplitRouter struct {
+	Default falcore.RequestFilter
+	KeyFunc SplitKeyFunc
+	table   atomic.Value
+	tableM  sync.Mutex
+}
+
+// Generate a new SplitRouter.  keyFunc may be nil for random assignment.
+func NewSplitRouter(def falcore.RequestFilter, keyFunc SplitKeyFunc) *SplitRouter {
+	r := &SplitRouter{Default: def, KeyFunc: keyFunc}
+	r.table.Store(&splitTable{})
+	return r
+}
+
+// Add a branch receiving percent (0-100) of the traffic.
+func (r *SplitRouter) AddBranch(name string, filter falcore.RequestFilter, percent float64) error {
+	r.tableM.Lock()
+	defer r.tableM.Unlock()
+
+	old := r.loadTable()
+	for _, b := range old.branches {
+		if b.Name == name {
+			return fmt.Errorf("SplitRouter: duplicate branch %v", name)
+		}
+	}
+	branches := make([]*SplitBranch, len(old.branches), len(old.branches)+1)
+	copy(branches, old.branches)
+	branches = append(branches, &SplitBranch{Name: name, Filter: filter, Percent: percent})
+	return r.storeTable(branches)
+}
+
+// Change the percentage of traffic sent to the named branch.  Safe to call
+// while requests are being routed.
+func (r *SplitRouter) SetPercent(name string, percent float64) error {
+	r.tableM.Lock()
+	defer r.tableM.Unlock()
+
+	old := r.loadTable()
+	branches := make([]*SplitBranch, len(old.branches))
+	found := false
+	for i, b := range old.branches {
+		if b.Name == name {
+			nb := *b
+			nb.Percent = percent
+			branches[i] = &nb
+			found = true
+		} else {
+			branches[i] = b
+		}
+	}
+	if !found {
+		return fmt.Errorf("SplitRouter: no branch named %v", name)
+	}
+	return r.storeTable(branches)
+}
+
+// Returns a copy of the current branches
+func (r *SplitRouter) Branches() []SplitBranch {
+	t := r.loadTable()
+	branches := make([]SplitBranch, len(t.branches))
+	for i, b := range t.branches {
+		branches[i] = *b
+	}
+	return branches
+}
+
+func (r *SplitRouter) SelectPipeline(req *falcore.Request) (pipe falcore.RequestFilter) {
+	t := r.loadTable()
+	bucket := r.bucket(req)
+	for i, bound := range t.bounds {
+		if bucket < bound {
+			req.CurrentStage.Status = byte(i + 1)
+			return t.branches[i].Filter
+		}
+	}
+	req.CurrentStage.Status = 0
+	return r.Default
+}
+
+// Implements falcore.PipelineBrancher.  Default is first.
+func (r *SplitRouter) PipelineBranches() []falcore.PipelineBranch {
+	t := r.loadTable()
+	branches := []falcore.PipelineBranch{{Label: "default", Filter: r.Default}}
+	for _, b := range t.branches {
+		branches = append(branches, falcore.PipelineBranch{
+			Label:  fmt.Sprintf("%v (%v%%)", b.Name, b.Percent),
+			Filter: b.Filter,
+		})
+	}
+	return branches
+}
+
+func (r *SplitRouter) bucket(req *falcore.Request) int {
+	if r.KeyFunc != nil {
+		if key := r.KeyFunc(req); key != "" {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return int(h.Sum32() % splitBuckets)
+		}
+	}
+	return rand.Intn(splitBuckets)
+}
+
+func (r *SplitRouter) loadTable() *splitTable {
+	return r.table.Load().(*splitTable)
+}
+
+// Must be called with tableM held
+func (r *SplitRouter) storeTable(branches []*SplitBranch) error {
+	if len(branches) > maxSplitBranches {
+		return fmt.Errorf("SplitRouter: more than %v branches", maxSplitBranches)
+	}
+	t := &splitTable{branches: branches, bounds: make([]int, len(branches))}
+	total := 0
+	for i, b := range branches {
+		if b.Percent < 0 || b.Percent > 100 {
+			return fmt.Errorf("SplitRouter: branch %v percent out of range: %v", b.Name, b.Percent)
+		}
+		total += int(b.Percent*splitBuckets/100 + 0.5)
+		t.bounds[i] = total
+	}
+	if total > splitBuckets {
+		return errors.New("SplitRouter: branch percentages add up to more than 100")
+	}
+	r.table.Store(t)
+	return nil
+}
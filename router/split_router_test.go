@@ -0,0 +1,93 @@
+package router
+
+import (
+	"fmt"
+	"github.com/fitstar/falcore"
+	"net/http"
+	"testing"
+)
+
+func TestSplitRouterPercent(t *testing.T) {
+	var sf1 SimpleFilter = 1
+	var sf2 SimpleFilter = 2
+	sr := NewSplitRouter(sf1, nil)
+	if err := sr.AddBranch("canary", sf2, 25); err != nil {
+		t.Fatalf("AddBranch: %v", err)
+	}
+
+	counts := make(map[falcore.RequestFilter]int)
+	for i := 0; i < 10000; i++ {
+		counts[sr.SelectPipeline(validGetRequest())]++
+	}
+	if c := counts[sf2]; c < 2000 || c > 3000 {
+		t.Errorf("Expected about 2500 canary requests, got %v", c)
+	}
+
+	sr.SetPercent("canary", 0)
+	for i := 0; i < 100; i++ {
+		if f := sr.SelectPipeline(validGetRequest()); f != sf1 {
+			t.Fatalf("Got canary with 0 percent")
+		}
+	}
+
+	if err := sr.SetPercent("missing", 10); err == nil {
+		t.Errorf("Expected error setting unknown branch")
+	}
+	if err := sr.AddBranch("canary", sf2, 10); err == nil {
+		t.Errorf("Expected error adding duplicate branch")
+	}
+	if err := sr.AddBranch("big", sf2, 101); err == nil {
+		t.Errorf("Expected error for over 100 percent")
+	}
+
+	// The branch number has to fit in the stage's Status
+	many := NewSplitRouter(sf1, nil)
+	for i := 0; i < 255; i++ {
+		if err := many.AddBranch(fmt.Sprint(i), sf2, 0); err != nil {
+			t.Fatalf("AddBranch %v: %v", i, err)
+		}
+	}
+	if err := many.AddBranch("256", sf2, 0); err == nil {
+		t.Errorf("Expected error for over 255 branches")
+	}
+}
+
+func TestSplitRouterSticky(t *testing.T) {
+	var sf1 SimpleFilter = 1
+	var sf2 SimpleFilter = 2
+	sr := NewSplitRouter(sf1, HeaderSplitKey("X-User"))
+	sr.AddBranch("b", sf2, 50)
+
+	for i := 0; i < 20; i++ {
+		req := validGetRequest()
+		req.HttpRequest.Header.Set("X-User", fmt.Sprintf("user%v", i))
+		first := sr.SelectPipeline(req)
+		status := req.CurrentStage.Status
+		for j := 0; j < 5; j++ {
+			if sr.SelectPipeline(req) != first || req.CurrentStage.Status != status {
+				t.Fatalf("Sticky assignment changed for user%v", i)
+			}
+		}
+	}
+}
+
+func TestSplitRouterSignature(t *testing.T) {
+	var sf2 SimpleFilter = 2
+	def := falcore.NewRequestFilter(func(req *falcore.Request) *http.Response {
+		return falcore.StringResponse(req.HttpRequest, 200, nil, "default")
+	})
+	sr := NewSplitRouter(def, nil)
+	sr.AddBranch("all", sf2, 100)
+	none := NewSplitRouter(def, nil)
+
+	sig := func(r falcore.Router) string {
+		p := falcore.NewPipeline()
+		p.Upstream.PushBack(r)
+		tmp, _ := http.NewRequest("GET", "/hello", nil)
+		req, _ := falcore.TestWithRequest(tmp, p, nil)
+		return req.Signature()
+	}
+	if sig(sr) == sig(none) {
+		t.Errorf("Branch choice should change the signature")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -24,9 +25,12 @@ import (
 // the socket stuff and processes requests.
 type Server struct {
 	Addr                string
-	Pipeline            *Pipeline
+	Pipeline            *Pipeline // the initial pipeline. use SetPipeline to replace it while serving
+	livePipeline        atomic.Value
+	livePipelineM       sync.Mutex
 	CompletionCallback  RequestCompletionCallback
 	ListenerTimeout     time.Duration // used to set deadline on listener (Default: 3s)
+	RequestTimeout      time.Duration // if set, the deadline for each request's HttpRequest.Context(). See TimeoutFilter
 	listener            net.Listener
 	listenerFile        *os.File
 	stopAccepting       chan struct{}
@@ -212,28 +216,36 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 	// We can't get the connection in this case.
 	// Need to be really careful about how we use this property elsewhere.
 	request := newRequest(req, nil, time.Now())
-	res := srv.handlerExecutePipeline(request, false)
-
-	// Copy headers
-	theHeader := wr.Header()
-	for key, header := range res.Header {
-		theHeader[key] = header
+	if srv.RequestTimeout > 0 {
+		defer request.setTimeout(srv.RequestTimeout)()
 	}
-
-	// Handle Content-Length
-	if res.ContentLength >= 0 {
-		theHeader.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	if h, ok := wr.(http.Hijacker); ok {
+		request.hijacker = h.Hijack
+	}
+	pipeline := srv.acquirePipeline()
+	defer pipeline.release()
+	res := srv.handlerExecutePipeline(pipeline.pipeline, request, false)
+	if request.hijacked {
+		srv.handlerHijacked(request, res)
+		return
 	}
 
 	// Write headers
-	wr.WriteHeader(res.StatusCode)
+	writeResponseHeader(wr, res)
 
 	// Write Body
 	request.startPipelineStage("server.ResponseWrite")
+	if f, ok := wr.(http.Flusher); ok {
+		request.responseFlusher = func() error {
+			f.Flush()
+			return nil
+		}
+	}
 	if res.Body != nil {
 		defer res.Body.Close()
 		io.Copy(wr, res.Body)
 	}
+	request.responseFlusher = nil
 	request.finishPipelineStage()
 	request.finishRequest()
 
@@ -242,15 +254,28 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 
 func (srv *Server) handler(c net.Conn) {
 	var startTime time.Time
+	// A hijacked connection and its buffers belong to the handler
+	hijacked := false
 	bpe := srv.bufferPool.Take(c)
-	defer srv.bufferPool.Give(bpe)
 	wbpe := srv.writeBufferPool.Take(c)
-	defer srv.writeBufferPool.Give(wbpe)
+	defer func() {
+		if !hijacked {
+			srv.bufferPool.Give(bpe)
+			srv.writeBufferPool.Give(wbpe)
+		}
+	}()
 	closeSentinelChan := make(chan struct{})
 	go srv.sentinel(c, closeSentinelChan)
-	defer srv.connectionFinished(c, closeSentinelChan)
+	defer srv.connectionFinished(c, closeSentinelChan, &hijacked)
 	var err error
 	var req *http.Request
+	// the live pipeline for the request in progress
+	var pipeline *pipelineRef
+	defer func() {
+		if pipeline != nil {
+			pipeline.release()
+		}
+	}()
 	// no keepalive (for now)
 	reqCount := 0
 	keepAlive := true
@@ -267,7 +292,14 @@ func (srv *Server) handler(c net.Conn) {
 				keepAlive = false
 			}
 			request := newRequest(req, c, startTime)
+			request.hijacker = func() (net.Conn, *bufio.ReadWriter, error) {
+				return c, bufio.NewReadWriter(bpe.Br, wbpe.Br), nil
+			}
 			reqCount++
+			cancel := func() {}
+			if srv.RequestTimeout > 0 {
+				cancel = request.setTimeout(srv.RequestTimeout)
+			}
 
 			pssInit := new(PipelineStageStat)
 			pssInit.Name = "server.Init"
@@ -277,7 +309,17 @@ func (srv *Server) handler(c net.Conn) {
 			request.appendPipelineStage(pssInit)
 
 			// execute the pipeline
-			var res = srv.handlerExecutePipeline(request, keepAlive)
+			pipeline = srv.acquirePipeline()
+			var res = srv.handlerExecutePipeline(pipeline.pipeline, request, keepAlive)
+
+			if request.hijacked {
+				srv.handlerHijacked(request, res)
+				pipeline.release()
+				pipeline = nil
+				cancel()
+				hijacked = true
+				return
+			}
 
 			// shutting down?
 			select {
@@ -292,6 +334,9 @@ func (srv *Server) handler(c net.Conn) {
 			if err != nil {
 				Error("%s ERROR writing response: <%T %v>", srv.serverLogPrefix(), err, err)
 			}
+			pipeline.release()
+			pipeline = nil
+			cancel()
 
 			if res.Close {
 				keepAlive = false
@@ -306,13 +351,10 @@ func (srv *Server) handler(c net.Conn) {
 	//Debug("%s Processed %v requests on connection %v", srv.serverLogPrefix(), reqCount, c.RemoteAddr())
 }
 
-func (srv *Server) handlerExecutePipeline(request *Request, keepAlive bool) *http.Response {
+func (srv *Server) handlerExecutePipeline(pipeline *Pipeline, request *Request, keepAlive bool) *http.Response {
 
-	var res *http.Response
-	// execute the pipeline
-	if res = srv.Pipeline.execute(request); res == nil {
-		res = StringResponse(request.HttpRequest, 404, nil, "Not Found")
-	}
+	// execute the pipeline.  It responds with a 404 if no filter does.
+	res := pipeline.serve(request)
 
 	// The res.Write omits Content-length on 0 length bodies, and by spec,
 	// it SHOULD. While this is not MUST, it's kinda broken.  See sec 4.4
@@ -356,8 +398,11 @@ func (srv *Server) handlerExecutePipeline(request *Request, keepAlive bool) *htt
 		res.Header.Set("Connection", "Keep-Alive")
 	}
 
-	// cleanup
-	request.HttpRequest.Body.Close()
+	// cleanup.  A hijacked request's body is read from the connection, which
+	// belongs to the handler now.
+	if !request.hijacked {
+		request.HttpRequest.Body.Close()
+	}
 	return res
 }
 
@@ -384,7 +429,9 @@ func (srv *Server) handlerWriteResponse(request *Request, res *http.Response, c
 	}
 
 	var err error
-	// Write response
+	// Write response.  Handlers may flush as it's written.
+	request.responseFlusher = bw.Flush
+	defer func() { request.responseFlusher = nil }()
 	if err = res.Write(bw); err != nil {
 		return err
 	}
@@ -395,6 +442,16 @@ func (srv *Server) handlerWriteResponse(request *Request, res *http.Response, c
 	return err
 }
 
+// Finish up a request whose handler took over the connection.  The
+// response is discarded.
+func (srv *Server) handlerHijacked(request *Request, res *http.Response) {
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	request.finishRequest()
+	srv.requestFinished(request, res)
+}
+
 func (srv *Server) serverLogPrefix() string {
 	return srv.logPrefix
 }
@@ -406,14 +463,16 @@ func (srv *Server) requestFinished(request *Request, res *http.Response) {
 	}
 }
 
-func (srv *Server) connectionFinished(c net.Conn, closeChan chan struct{}) {
+func (srv *Server) connectionFinished(c net.Conn, closeChan chan struct{}, hijacked *bool) {
 	if srv.PanicHandler != nil {
 		if err := recover(); err != nil {
 			srv.PanicHandler(c, err)
 		}
 	}
 
-	c.Close()
+	if !*hijacked {
+		c.Close()
+	}
 	close(closeChan)
 	srv.handlerWaitGroup.Done()
 }
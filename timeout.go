@@ -0,0 +1,126 @@
+package falcore
+
+import (
+	"container/list"
+	"context"
+	"hash/crc32"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Wraps a RequestFilter with a deadline.  The wrapped filter runs on its own
+// goroutine with a copy of the Request whose HttpRequest.Context() is
+// cancelled when the deadline passes.  If the filter hasn't returned by then,
+// TimeoutFilter stops waiting and responds with StatusCode (504 by default)
+// and the filter's stage is recorded with Status 2 (Fail).  Any response the
+// filter returns after that is discarded.
+//
+// The deadline is the earlier of Timeout and the deadline already on the
+// request, such as Server.RequestTimeout or an enclosing TimeoutFilter.
+// Filters should watch HttpRequest.Context() and give up when it's done.
+// filter.Upstream does this automatically.
+//
+// The copy of the Request shares Context and HttpRequest headers with the
+// original.  A filter that keeps running after its deadline must not
+// modify them.
+//
+// Stats for the wrapped filter, including any nested Pipeline, are merged
+// into the Request when it finishes in time.
+type TimeoutFilter struct {
+	Filter     RequestFilter
+	Timeout    time.Duration
+	StatusCode int
+}
+
+func NewTimeoutFilter(filter RequestFilter, timeout time.Duration) *TimeoutFilter {
+	return &TimeoutFilter{Filter: filter, Timeout: timeout, StatusCode: 504}
+}
+
+func (f *TimeoutFilter) FilterRequest(req *Request) *http.Response {
+	res, err := f.FilterRequestE(req)
+	if err != nil {
+		return RenderError(req, err)
+	}
+	return res
+}
+
+// Implements RequestFilterE.  Returns an *HTTPError if the deadline passes.
+func (f *TimeoutFilter) FilterRequestE(req *Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.HttpRequest.Context(), f.Timeout)
+	child := req.fork(ctx)
+	start := time.Now()
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		done <- execFilter(child, f.Filter)
+	}()
+
+	select {
+	case res := <-done:
+		cancel()
+		req.join(child)
+		return res, nil
+	case <-ctx.Done():
+		cancel()
+		// Clean up whenever it does finish
+		go func() {
+			if res := <-done; res != nil && res.Body != nil {
+				res.Body.Close()
+			}
+		}()
+	}
+
+	pss := NewPiplineStage(reflect.TypeOf(f.Filter).String())
+	pss.StartTime = start
+	pss.EndTime = time.Now()
+	pss.Type = PipelineStageTypeUpstream
+	pss.Status = 2 // Fail
+	req.appendPipelineStage(pss)
+
+	status := f.StatusCode
+	if status == 0 {
+		status = 504
+	}
+	return nil, NewHTTPError(status, "", ctx.Err())
+}
+
+// Returns a copy of the Request for running a filter concurrently.
+// The copy uses ctx and has its own stats.
+func (fReq *Request) fork(ctx context.Context) *Request {
+	child := new(Request)
+	*child = *fReq
+	child.HttpRequest = fReq.HttpRequest.WithContext(ctx)
+	child.PipelineStageStats = list.New()
+	child.CurrentStage = nil
+	child.pipelineHash = crc32.NewIEEE()
+	child.piplineTot = 0
+	return child
+}
+
+// Merges the stats from a forked Request that has finished
+func (fReq *Request) join(child *Request) {
+	for e := child.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		fReq.appendPipelineStage(e.Value.(*PipelineStageStat))
+	}
+}
+
+// Records that the request ran out of time before a stage could start
+// and returns a 503
+func (fReq *Request) deadlineExceeded(err error) *http.Response {
+	pss := NewPiplineStage("falcore.Deadline")
+	pss.EndTime = pss.StartTime
+	pss.Status = 2 // Fail
+	fReq.appendPipelineStage(pss)
+	return fReq.filterError(NewHTTPError(503, "", err))
+}
+
+// Limit the time a request may take.  The deadline is attached to
+// HttpRequest.Context() so it flows to every filter, nested Pipeline and
+// TimeoutFilter.  Returns a func that releases the resources; call it
+// once the response has been written.
+func (fReq *Request) setTimeout(timeout time.Duration) context.CancelFunc {
+	ctx, cancel := context.WithTimeout(fReq.HttpRequest.Context(), timeout)
+	fReq.HttpRequest = fReq.HttpRequest.WithContext(ctx)
+	return cancel
+}
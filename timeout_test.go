@@ -0,0 +1,107 @@
+package falcore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutFilterExpires(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	slow := NewRequestFilter(func(req *Request) *http.Response {
+		select {
+		case <-req.HttpRequest.Context().Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+		}
+		return StringResponse(req.HttpRequest, 200, nil, "slow")
+	})
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(slow, 20*time.Millisecond))
+
+	req := validGetRequest()
+	start := time.Now()
+	res := p.execute(req)
+	if res.StatusCode != 504 {
+		t.Errorf("Expected 504, got %v", res.StatusCode)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Timeout took too long: %v", d)
+	}
+	if !<-cancelled {
+		t.Errorf("Filter context wasn't cancelled")
+	}
+	if req.PipelineStageStats.Len() != 1 {
+		t.Fatalf("Expected 1 stage, got %v", req.PipelineStageStats.Len())
+	}
+	if pss := req.CurrentStage; pss.Status != 2 || pss.Name != "*falcore.genericRequestFilter" {
+		t.Errorf("Bad stage: %v %v", pss.Name, pss.Status)
+	}
+}
+
+func TestTimeoutFilterMergesStats(t *testing.T) {
+	inner := NewPipeline()
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		req.CurrentStage.Status = 1
+		return nil
+	}))
+	inner.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		return StringResponse(req.HttpRequest, 200, nil, "OK")
+	}))
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(inner, time.Second))
+
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 200 {
+		t.Errorf("Expected 200, got %v", res.StatusCode)
+	}
+	if req.PipelineStageStats.Len() != 2 {
+		t.Fatalf("Expected 2 stages, got %v", req.PipelineStageStats.Len())
+	}
+	if pss := req.PipelineStageStats.Front().Value.(*PipelineStageStat); pss.Status != 1 {
+		t.Errorf("Inner stage status lost: %v", pss.Status)
+	}
+}
+
+func TestPipelineDeadlineExceeded(t *testing.T) {
+	ran := false
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		ran = true
+		return nil
+	}))
+
+	req := validGetRequest()
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	req.HttpRequest = req.HttpRequest.WithContext(ctx)
+	if res := p.execute(req); res == nil || res.StatusCode != 503 {
+		t.Errorf("Expected 503, got %v", res)
+	}
+	if ran {
+		t.Errorf("Filter shouldn't run after the deadline")
+	}
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(NewRequestFilter(func(req *Request) *http.Response {
+		<-req.HttpRequest.Context().Done()
+		return nil
+	}), time.Minute))
+	srv := NewServer(0, p)
+	srv.RequestTimeout = 20 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 504 {
+		t.Errorf("Expected 504, got %v", rec.Code)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Request budget wasn't applied: %v", d)
+	}
+}
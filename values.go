@@ -0,0 +1,122 @@
+package falcore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A typed key for values attached to a Request.  Unlike Request.Context,
+// the type of the value is checked at compile time and keys from different
+// packages can't collide, even if they have the same name.  Keys are
+// compared by identity so they should be created once, usually as package
+// level variables:
+//
+//	var UserKey = falcore.NewKey[*User]("user")
+//
+//	UserKey.Set(req, user)
+//	if user, ok := UserKey.Get(req); ok { ... }
+//
+// Values are safe to use from multiple goroutines.  Copies of the Request
+// made by TimeoutFilter and FanOutFilter share values with the original.
+type Key[T any] struct {
+	name string
+}
+
+// Generate a new Key.  name is only used for debugging.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+// Returns the value for this key and whether it was set.  A nil stored
+// under an interface type comes back as nil with ok set.
+func (k *Key[T]) Get(req *Request) (v T, ok bool) {
+	var raw interface{}
+	if raw, ok = req.values.get(k); ok {
+		v, _ = raw.(T)
+	}
+	return
+}
+
+// Returns the value for this key or def if it isn't set
+func (k *Key[T]) GetDefault(req *Request, def T) T {
+	if v, ok := k.Get(req); ok {
+		return v
+	}
+	return def
+}
+
+func (k *Key[T]) Set(req *Request, v T) {
+	req.valueStore().set(k, v)
+}
+
+func (k *Key[T]) Delete(req *Request) {
+	req.values.delete(k)
+}
+
+// Pairs the key with v for seeding a Request in TestWithRequest
+func (k *Key[T]) Value(v T) KeyValue {
+	return keyValue{k, v}
+}
+
+func (k *Key[T]) String() string {
+	var zero T
+	return fmt.Sprintf("falcore.Key[%T](%s)", zero, k.name)
+}
+
+// A key and value to set on a Request.  See Key.Value.
+type KeyValue interface {
+	apply(req *Request)
+}
+
+type keyValue struct {
+	key   interface{}
+	value interface{}
+}
+
+func (kv keyValue) apply(req *Request) {
+	req.valueStore().set(kv.key, kv.value)
+}
+
+// Requests from newRequest always have a store.  This covers ones built
+// by hand.
+func (fReq *Request) valueStore() *requestValues {
+	if fReq.values == nil {
+		fReq.values = new(requestValues)
+	}
+	return fReq.values
+}
+
+// The storage behind Key.  It's shared by pointer so forked Requests see
+// the same values.
+type requestValues struct {
+	mu sync.RWMutex
+	m  map[interface{}]interface{}
+}
+
+func (rv *requestValues) get(key interface{}) (interface{}, bool) {
+	if rv == nil {
+		return nil, false
+	}
+	rv.mu.RLock()
+	v, ok := rv.m[key]
+	rv.mu.RUnlock()
+	return v, ok
+}
+
+func (rv *requestValues) set(key, value interface{}) {
+	rv.mu.Lock()
+	if rv.m == nil {
+		rv.m = make(map[interface{}]interface{})
+	}
+	rv.m[key] = value
+	rv.mu.Unlock()
+}
+
+func (rv *requestValues) delete(key interface{}) {
+	if rv == nil {
+		return
+	}
+	rv.mu.Lock()
+	delete(rv.m, key)
+	rv.mu.Unlock()
+}
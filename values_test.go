@@ -0,0 +1,97 @@
+package falcore
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	Name string
+}
+
+var (
+	testUserKey  = NewKey[*testUser]("user")
+	testCountKey = NewKey[int]("count")
+	// Same name, different key
+	testOtherCountKey = NewKey[int]("count")
+)
+
+func TestKeyGetSet(t *testing.T) {
+	req := validGetRequest()
+	if _, ok := testUserKey.Get(req); ok {
+		t.Errorf("Value shouldn't be set")
+	}
+	testUserKey.Set(req, &testUser{"bob"})
+	testCountKey.Set(req, 3)
+	if u, ok := testUserKey.Get(req); !ok || u.Name != "bob" {
+		t.Errorf("Bad user: %v %v", u, ok)
+	}
+	if c := testCountKey.GetDefault(req, 0); c != 3 {
+		t.Errorf("Expected 3, got %v", c)
+	}
+	if c := testOtherCountKey.GetDefault(req, -1); c != -1 {
+		t.Errorf("Keys with the same name collided: %v", c)
+	}
+	testCountKey.Delete(req)
+	if _, ok := testCountKey.Get(req); ok {
+		t.Errorf("Value wasn't deleted")
+	}
+	if s := testCountKey.String(); s != "falcore.Key[int](count)" {
+		t.Errorf("Bad name: %v", s)
+	}
+}
+
+func TestKeyNilInterface(t *testing.T) {
+	errKey := NewKey[error]("error")
+	req := validGetRequest()
+	errKey.Set(req, nil)
+	if err, ok := errKey.Get(req); !ok || err != nil {
+		t.Errorf("Expected a set nil, got %v %v", err, ok)
+	}
+
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	TestWithRequest(tmp, NewRequestFilter(func(req *Request) *http.Response {
+		if err, ok := errKey.Get(req); !ok || err != nil {
+			t.Errorf("Expected a seeded nil, got %v %v", err, ok)
+		}
+		return StringResponse(req.HttpRequest, 200, nil, "")
+	}), nil, errKey.Value(nil))
+}
+
+func TestKeyConcurrent(t *testing.T) {
+	req := validGetRequest()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			testCountKey.Set(req, i)
+			testCountKey.Get(req)
+		}(i)
+	}
+	wg.Wait()
+
+	// Forked requests share values
+	p := NewPipeline()
+	p.Upstream.PushBack(NewTimeoutFilter(NewRequestFilter(func(req *Request) *http.Response {
+		testUserKey.Set(req, &testUser{"alice"})
+		return StringResponse(req.HttpRequest, 200, nil, "")
+	}), time.Second))
+	p.execute(req)
+	if u, ok := testUserKey.Get(req); !ok || u.Name != "alice" {
+		t.Errorf("Value set in forked request was lost")
+	}
+}
+
+func TestWithRequestValues(t *testing.T) {
+	tmp, _ := http.NewRequest("GET", "/", nil)
+	_, res := TestWithRequest(tmp, NewRequestFilter(func(req *Request) *http.Response {
+		u, _ := testUserKey.Get(req)
+		return StringResponse(req.HttpRequest, 200, nil, u.Name)
+	}), nil, testUserKey.Value(&testUser{"carol"}))
+	if res.ContentLength != 5 {
+		t.Errorf("Seeded value wasn't visible: %v", res.ContentLength)
+	}
+}